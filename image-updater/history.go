@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"dagger/image-updater/internal/dagger"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// HistoryEntry is a record of an update in the history file of the repository
+type HistoryEntry struct {
+	// Time of the update in RFC3339 format
+	Timestamp string
+	// Image that was set by the update
+	Image string
+	// Image of the first container of the first file before the update
+	PreviousImage string
+	// Git user that made the update
+	Author string
+	// Free-form metadata of the update
+	Metadata []*HistoryMetadata
+}
+
+// HistoryMetadata is a key/value pair of the metadata of a history entry
+type HistoryMetadata struct {
+	Key   string
+	Value string
+}
+
+// historyRecord is the representation of each of the lines of the history file.
+type historyRecord struct {
+	Timestamp     string            `json:"timestamp"`
+	Image         string            `json:"image"`
+	PreviousImage string            `json:"previousImage,omitempty"`
+	Author        string            `json:"author"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+// History reads the history file of the repository returning each of the updates
+// that were recorded by `update`, oldest first.
+func (m *ImageUpdater) History(ctx context.Context,
+	// repository to clone
+	repo string,
+	// branch to checkout
+	branch string,
+	// path of the history file in the repository
+	file string,
+	// username to authenticate against git server
+	// +optional
+	gitUser string,
+	// password to authenticate against git server
+	// +optional
+	gitPassword *dagger.Secret,
+	// if specified only the last entries are returned
+	// +optional
+	last int,
+) ([]*HistoryEntry, error) {
+	var auth transport.AuthMethod
+	if gitPassword != nil {
+		password, err := gitPassword.Plaintext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		auth = &http.BasicAuth{
+			Username: gitUser,
+			Password: password,
+		}
+	}
+
+	// The file is read directly from the tree of the HEAD commit so the
+	// repository doesn't need to be checked out
+	repository, err := git.CloneContext(ctx, memory.NewStorage(), nil, &git.CloneOptions{
+		URL:           repo,
+		Auth:          auth,
+		ReferenceName: plumbing.NewBranchReferenceName(branch),
+		Depth:         1,
+		SingleBranch:  true,
+		NoCheckout:    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := repository.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := repository.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := commit.File(file)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return []*HistoryEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := f.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	entries := []*HistoryEntry{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		record := historyRecord{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, err
+		}
+
+		entry := &HistoryEntry{
+			Timestamp:     record.Timestamp,
+			Image:         record.Image,
+			PreviousImage: record.PreviousImage,
+			Author:        record.Author,
+			Metadata:      []*HistoryMetadata{},
+		}
+		for key, value := range record.Metadata {
+			entry.Metadata = append(entry.Metadata, &HistoryMetadata{Key: key, Value: value})
+		}
+		sort.Slice(entry.Metadata, func(i, j int) bool { return entry.Metadata[i].Key < entry.Metadata[j].Key })
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if last > 0 && last < len(entries) {
+		entries = entries[len(entries)-last:]
+	}
+	return entries, nil
+}
+
+// appendHistory appends the record to the history file in the worktree, creating
+// the file if it does not exist, and adds it to the index.
+func appendHistory(worktree *git.Worktree, filePath string, record historyRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	contents := []byte{}
+	file, err := worktree.Filesystem.Open(filePath)
+	switch {
+	case err == nil:
+		contents, err = io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if err := worktree.Filesystem.MkdirAll(path.Dir(filePath), 0o755); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	if len(contents) > 0 && contents[len(contents)-1] != '\n' {
+		contents = append(contents, '\n')
+	}
+	contents = append(contents, line...)
+	contents = append(contents, '\n')
+
+	f, err := worktree.Filesystem.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	_, err = worktree.Add(filePath)
+	return err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+const (
+	// LockRefPrefix is the prefix of the references that hold the lock of each branch
+	LockRefPrefix = "refs/image-updater/locks/"
+	// DefaultLockLease is how long a lock is held before other updaters can take it over
+	DefaultLockLease = 5 * time.Minute
+	// DefaultLockTimeout is how long an updater waits for a lock before failing
+	DefaultLockTimeout = 10 * time.Minute
+
+	lockRetryInterval = 5 * time.Second
+)
+
+// repoLock is a lease-based lock that serializes the updates made to a branch of
+// a repository. The lock lives on its own reference in the remote and each change
+// to it (acquire, take over or release) is a commit that is pushed as a fast-forward
+// of the previous one. This way the git server rejects the push if another updater
+// changed the lock in the meantime.
+type repoLock struct {
+	repository *git.Repository
+	auth       *http.BasicAuth
+	ref        plumbing.ReferenceName
+	owner      string
+	signature  *object.Signature
+	// hash of the commit that holds the lock
+	hash plumbing.Hash
+}
+
+// lockState is the content of the message of each of the lock commits.
+type lockState struct {
+	Owner    string    `json:"owner"`
+	Expires  time.Time `json:"expires"`
+	Released bool      `json:"released,omitempty"`
+}
+
+// acquireLock waits until the lock of the branch is free or its lease expired and
+// takes it. It fails if the lock could not be taken before the timeout.
+func acquireLock(ctx context.Context, repo string, auth *http.BasicAuth, branch, owner string, signature *object.Signature, lease, timeout time.Duration) (*repoLock, error) {
+	repository, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := repository.CreateRemote(&config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{repo},
+	}); err != nil {
+		return nil, err
+	}
+
+	l := &repoLock{
+		repository: repository,
+		auth:       auth,
+		ref:        plumbing.ReferenceName(LockRefPrefix + branch),
+		owner:      owner,
+		signature:  signature,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		current, state, err := l.current(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if state == nil || state.Released || time.Now().After(state.Expires) {
+			err = l.push(ctx, current, lockState{
+				Owner:   owner,
+				Expires: time.Now().Add(lease),
+			})
+			if err == nil {
+				return l, nil
+			}
+		} else {
+			err = fmt.Errorf("lock is held by %s until %s", state.Owner, state.Expires.Format(time.RFC3339))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for lock %s: %w", l.ref, err)
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// release frees the lock so that other updaters can take it. It fails if the
+// lease expired and the lock was taken by someone else.
+func (l *repoLock) release(ctx context.Context) error {
+	current, state, err := l.current(ctx)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("lock %s no longer exists", l.ref)
+	}
+	if current != l.hash {
+		return fmt.Errorf("lease expired and the lock was taken over by %s", state.Owner)
+	}
+
+	return l.push(ctx, l.hash, lockState{
+		Owner:    l.owner,
+		Expires:  time.Now(),
+		Released: true,
+	})
+}
+
+// current fetches the lock reference returning the hash of the commit that
+// holds the lock and its state. Both are empty if the lock was never taken.
+func (l *repoLock) current(ctx context.Context) (plumbing.Hash, *lockState, error) {
+	err := l.repository.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       l.auth,
+		RefSpecs:   []config.RefSpec{config.RefSpec("+" + l.ref + ":" + l.ref)},
+		Depth:      1,
+	})
+	if errors.Is(err, git.NoMatchingRefSpecError{}) {
+		return plumbing.ZeroHash, nil, nil
+	}
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return plumbing.ZeroHash, nil, err
+	}
+
+	ref, err := l.repository.Reference(l.ref, true)
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+
+	commit, err := l.repository.CommitObject(ref.Hash())
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+
+	state := &lockState{}
+	if err := json.Unmarshal([]byte(commit.Message), state); err != nil {
+		return plumbing.ZeroHash, nil, fmt.Errorf("invalid lock %s: %w", l.ref, err)
+	}
+	return commit.Hash, state, nil
+}
+
+// push writes a new commit with the state on top of parent and pushes it to the
+// lock reference.
+func (l *repoLock) push(ctx context.Context, parent plumbing.Hash, state lockState) error {
+	msg, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	treeHash, err := storeObject(l.repository, &object.Tree{})
+	if err != nil {
+		return err
+	}
+
+	commit := &object.Commit{
+		Author:    *l.signature,
+		Committer: *l.signature,
+		Message:   string(msg),
+		TreeHash:  treeHash,
+	}
+	commit.Author.When = time.Now()
+	commit.Committer.When = commit.Author.When
+	if !parent.IsZero() {
+		commit.ParentHashes = []plumbing.Hash{parent}
+	}
+
+	hash, err := storeObject(l.repository, commit)
+	if err != nil {
+		return err
+	}
+	if err := l.repository.Storer.SetReference(plumbing.NewHashReference(l.ref, hash)); err != nil {
+		return err
+	}
+
+	if err := l.repository.PushContext(ctx, &git.PushOptions{
+		RemoteName: "origin",
+		Auth:       l.auth,
+		RefSpecs:   []config.RefSpec{config.RefSpec(l.ref + ":" + l.ref)},
+	}); err != nil {
+		return err
+	}
+
+	l.hash = hash
+	return nil
+}
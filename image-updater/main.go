@@ -18,26 +18,43 @@ package main
 import (
 	"context"
 	"dagger/image-updater/internal/dagger"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 )
 
 const YqVersion = "4.40.7"
 
+// NotesRef is the reference where the git notes with the metadata of each
+// update are stored. It is the default reference used by `git notes`.
+const NotesRef = plumbing.ReferenceName("refs/notes/commits")
+
+// DefaultCommitTrailer is the trailer added to the commits made by the updater
+const DefaultCommitTrailer = "Updated-By: image-updater"
+
 type ImageUpdater struct{}
 
 // Update updates the kubernetes deployment file in the specified repository
 // with the new image URL.
 // NOTE: this pushes a commit to your repository so make sure that you either
-// don't have a cyclic workflow trigger or that you use a token that prevents
-// this from happening.
+// don't have a cyclic workflow trigger, that you use a token that prevents
+// this from happening or that you set skipSelfTriggered so that the update is
+// skipped when the branch is at a commit made by the updater itself.
 func (m *ImageUpdater) Update(ctx context.Context,
 	// name of the application that is being updated. appName is used on the commit message
 	// if no name is provided then a generic message is committed.
@@ -63,10 +80,105 @@ func (m *ImageUpdater) Update(ctx context.Context,
 	// list of container IDs to update on each of the files
 	// +optional
 	containers []int,
+	// labels to set on the workload and its pod template in the form key=value.
+	// Values are templates rendered with the image, for example:
+	// app.kubernetes.io/version={{ .Tag }}
+	// +optional
+	labels []string,
+	// annotations to set on the workload and its pod template in the form key=value.
+	// Values are templates rendered with the image, for example:
+	// kubernetes.io/change-cause=Rolling out {{ .Image }}
+	// +optional
+	annotations []string,
+	// environment variables to set on each of the updated containers in the form
+	// NAME=value. Values are templates rendered with the image, for example:
+	// VERSION={{ .Tag }}
+	// +optional
+	envVars []string,
+	// name of a git tag created on the commit and pushed along with the branch.
+	// The name is a template rendered with the image, for example:
+	// deploy/{{ .AppName }}/{{ .Tag }}
+	// +optional
+	tag string,
+	// message of the tag. If specified an annotated tag is created, otherwise
+	// the tag is lightweight. The message is a template rendered with the image
+	// +optional
+	tagMessage string,
+	// metadata attached to the commit as a JSON object in a git note under
+	// refs/notes/commits in the form key=value. Values are templates rendered
+	// with the image, for example: digest={{ .Digest }}
+	// +optional
+	noteMetadata []string,
+	// if specified then the updates made to the same repository and branch are
+	// serialized with a lease-based lock held in the refs/image-updater/locks/<branch>
+	// reference of the repository. Concurrent updates wait for the lock instead of failing
+	// +optional
+	lock bool,
+	// duration of the lease of the lock, it should be longer than the update itself.
+	// After it expires other updaters can take the lock over. Defaults to 5m
+	// +optional
+	lockLease string,
+	// how long to wait for the lock before failing. Defaults to 10m
+	// +optional
+	lockTimeout string,
+	// path of a JSON lines file in the repository where a record of the update is
+	// appended. The path is a template rendered with the image, for example:
+	// deployments/{{ .AppName }}.jsonl
+	// +optional
+	historyFile string,
+	// metadata of the record appended to the history file in the form key=value.
+	// Values are templates rendered with the image
+	// +optional
+	historyMetadata []string,
+	// if specified then the update is skipped when the HEAD commit of the branch
+	// was authored with gitEmail or carries the commit trailer. This breaks the
+	// loops of workflows that are triggered by the commits of the updater
+	// +optional
+	skipSelfTriggered bool,
+	// trailer that is added to every commit made by the updater and that is
+	// checked by skipSelfTriggered. Defaults to "Updated-By: image-updater"
+	// +optional
+	commitTrailer string,
 ) error {
 	if len(containers) == 0 {
 		containers = []int{0}
 	}
+	if tagMessage != "" && tag == "" {
+		return errors.New("tagMessage requires a tag")
+	}
+	if historyFile != "" && len(files) == 0 {
+		return errors.New("historyFile requires at least one file to read the previous image from")
+	}
+	if commitTrailer == "" {
+		commitTrailer = DefaultCommitTrailer
+	}
+
+	ref := newImageRef(appName, imageUrl)
+	edits, err := imageEdits(ref, containers, labels, annotations, envVars)
+	if err != nil {
+		return err
+	}
+
+	tagName, err := render(tag, ref)
+	if err != nil {
+		return err
+	}
+	tagMsg, err := render(tagMessage, ref)
+	if err != nil {
+		return err
+	}
+	note, err := noteContents(noteMetadata, ref)
+	if err != nil {
+		return err
+	}
+	historyPath, err := render(historyFile, ref)
+	if err != nil {
+		return err
+	}
+	historyKvs, err := renderKeyValues(historyMetadata, ref)
+	if err != nil {
+		return err
+	}
 
 	githubPassword, err := gitPassword.Plaintext(ctx)
 	if err != nil {
@@ -85,7 +197,42 @@ func (m *ImageUpdater) Update(ctx context.Context,
 		Password: githubPassword,
 	}
 
-	repository, err := git.PlainClone("/tmp/repo", false, &git.CloneOptions{
+	signature := &object.Signature{
+		Name:  gitUser,
+		Email: gitEmail,
+		When:  time.Now(),
+	}
+
+	// Each update gets its own working directory so that concurrent calls
+	// don't clone on top of each other
+	dir, err := os.MkdirTemp("", "repo-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if lock {
+		lease, err := parseDuration(lockLease, DefaultLockLease)
+		if err != nil {
+			return err
+		}
+		timeout, err := parseDuration(lockTimeout, DefaultLockTimeout)
+		if err != nil {
+			return err
+		}
+
+		l, err := acquireLock(ctx, repo, repoAuth, branch, filepath.Base(dir), signature, lease, timeout)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := l.release(context.WithoutCancel(ctx)); err != nil {
+				log.Printf("failed to release lock %s: %s", l.ref, err)
+			}
+		}()
+	}
+
+	repository, err := git.PlainClone(dir, false, &git.CloneOptions{
 		URL:           repo,
 		Auth:          repoAuth,
 		ReferenceName: plumbing.NewBranchReferenceName(branch),
@@ -96,12 +243,36 @@ func (m *ImageUpdater) Update(ctx context.Context,
 		return err
 	}
 
+	if skipSelfTriggered {
+		head, err := repository.Head()
+		if err != nil {
+			return err
+		}
+		headCommit, err := repository.CommitObject(head.Hash())
+		if err != nil {
+			return err
+		}
+		if isSelfTriggered(headCommit, gitEmail, commitTrailer) {
+			log.Printf("skipping update: HEAD commit %s of %s was made by the updater", headCommit.Hash, branch)
+			return nil
+		}
+	}
+
 	worktree, err := repository.Worktree()
 	if err != nil {
 		return err
 	}
 
-	if err := m.updateFiles(ctx, yqContainer, worktree, imageUrl, files, containers); err != nil {
+	// The previous image has to be read before the files are updated
+	var previousImage string
+	if historyPath != "" {
+		previousImage, err = m.currentImage(ctx, yqContainer, worktree, files[0], containers[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := m.updateFiles(ctx, yqContainer, worktree, files, edits); err != nil {
 		return err
 	}
 
@@ -112,17 +283,34 @@ func (m *ImageUpdater) Update(ctx context.Context,
 		}
 	}
 
+	if historyPath != "" {
+		record := historyRecord{
+			Timestamp:     time.Now().UTC().Format(time.RFC3339),
+			Image:         imageUrl,
+			PreviousImage: previousImage,
+			Author:        gitUser,
+		}
+		if len(historyKvs) > 0 {
+			record.Metadata = make(map[string]string, len(historyKvs))
+			for _, kv := range historyKvs {
+				record.Metadata[kv.key] = kv.value
+			}
+		}
+		if err := appendHistory(worktree, historyPath, record); err != nil {
+			return err
+		}
+	}
+
 	msg := fmt.Sprintf("Updating resource with image: %s", imageUrl)
 	if appName != "" {
 		msg = fmt.Sprintf("Updating %s resource with image: %s", appName, imageUrl)
 	}
-	if _, err := worktree.Commit(msg, &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  gitUser,
-			Email: gitEmail,
-			When:  time.Now(),
-		},
-	}); err != nil {
+	msg += "\n\n" + commitTrailer
+	signature.When = time.Now()
+	commit, err := worktree.Commit(msg, &git.CommitOptions{
+		Author: signature,
+	})
+	if err != nil {
 		return err
 	}
 
@@ -134,17 +322,227 @@ func (m *ImageUpdater) Update(ctx context.Context,
 			config.RefSpec(refName + ":" + refName),
 		},
 	}
+
+	// Leases of the references pushed along with the branch when pushing with
+	// --force-with-lease
+	leases := map[plumbing.ReferenceName]plumbing.Hash{}
+
+	if tagName != "" {
+		var opts *git.CreateTagOptions
+		if tagMsg != "" {
+			opts = &git.CreateTagOptions{Tagger: signature, Message: tagMsg}
+		}
+		tagRef, err := repository.CreateTag(tagName, commit, opts)
+		if err != nil {
+			return err
+		}
+		pushOptions.RefSpecs = append(pushOptions.RefSpecs, config.RefSpec(tagRef.Name()+":"+tagRef.Name()))
+		// The tag must not exist in the remote yet
+		leases[tagRef.Name()] = plumbing.ZeroHash
+	}
+
+	if note != nil {
+		notesBase, err := addNote(ctx, repository, repoAuth, commit, signature, note)
+		if err != nil {
+			return err
+		}
+		pushOptions.RefSpecs = append(pushOptions.RefSpecs, config.RefSpec(NotesRef+":"+NotesRef))
+		// The notes must not have changed since they were fetched
+		leases[NotesRef] = notesBase
+	}
+
 	if forceWithLease {
+		if err := setLeases(repository, pushOptions.RemoteName, leases); err != nil {
+			return err
+		}
 		pushOptions.ForceWithLease = &git.ForceWithLease{}
 	}
 
+	// The branch, tag and notes are pushed all at once so that the update
+	// commit doesn't land without them, a retry would deploy it twice
+	if len(pushOptions.RefSpecs) > 1 {
+		pushOptions.Atomic = true
+	}
+
 	return repository.PushContext(ctx, pushOptions)
 }
 
-// updateFiles opens each file at the specified filepath, edits the image spec setting
-// for each of the containers with the new image URL that was specified and writes
-// the file back to the worktree
-func (m *ImageUpdater) updateFiles(ctx context.Context, yq *dagger.Container, worktree *git.Worktree, imageUrl string, files []string, containers []int) error {
+// currentImage returns the image of the container in the file before it is updated.
+func (m *ImageUpdater) currentImage(ctx context.Context, yq *dagger.Container, worktree *git.Worktree, filePath string, container int) (string, error) {
+	file, err := worktree.Filesystem.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	deployment, err := io.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+
+	image, err := yq.
+		WithNewFile("deployment.yaml", string(deployment)).
+		WithoutEntrypoint().
+		WithExec([]string{"yq", fmt.Sprintf(".spec.template.spec.containers[%d].image // \"\"", container), "deployment.yaml"}).
+		Stdout(ctx)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(image), nil
+}
+
+// isSelfTriggered returns whether the commit was authored by the updater identity
+// or has the trailer that the updater adds to its commits.
+func isSelfTriggered(commit *object.Commit, email, trailer string) bool {
+	if strings.EqualFold(commit.Author.Email, email) {
+		return true
+	}
+	for _, line := range strings.Split(commit.Message, "\n") {
+		if strings.TrimSpace(line) == trailer {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDuration parses the duration returning the default value if it is empty.
+func parseDuration(duration string, defaultValue time.Duration) (time.Duration, error) {
+	if duration == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(duration)
+}
+
+// noteContents returns the JSON object with the rendered metadata that is attached
+// to the commit as a git note. It returns nil if there is no metadata.
+func noteContents(metadata []string, ref imageRef) ([]byte, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+
+	kvs, err := renderKeyValues(metadata, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	note := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		note[kv.key] = kv.value
+	}
+	return json.MarshalIndent(note, "", "  ")
+}
+
+// addNote attaches the note to the commit creating a new commit on the notes
+// reference of the repository. go-git has no support for git notes so the blob,
+// tree and commit are written directly to the storer. It returns the notes commit
+// that the new one was added on top of, or the zero hash if there were no notes.
+func addNote(ctx context.Context, repository *git.Repository, auth *http.BasicAuth, commit plumbing.Hash, signature *object.Signature, note []byte) (plumbing.Hash, error) {
+	// The notes reference is not part of the branch we cloned so it has to be
+	// fetched explicitly. It does not exist until the first note is pushed.
+	err := repository.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       auth,
+		RefSpecs:   []config.RefSpec{config.RefSpec("+" + NotesRef + ":" + NotesRef)},
+		Depth:      1,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) && !errors.Is(err, git.NoMatchingRefSpecError{}) {
+		return plumbing.ZeroHash, err
+	}
+
+	entries := []object.TreeEntry{}
+	parents := []plumbing.Hash{}
+	if current, err := repository.Reference(NotesRef, true); err == nil {
+		notesCommit, err := repository.CommitObject(current.Hash())
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tree, err := notesCommit.Tree()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		for _, entry := range tree.Entries {
+			if entry.Name != commit.String() {
+				entries = append(entries, entry)
+			}
+		}
+		parents = append(parents, notesCommit.Hash)
+	}
+
+	blob := repository.Storer.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	w, err := blob.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := w.Write(note); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	blobHash, err := repository.Storer.SetEncodedObject(blob)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	entries = append(entries, object.TreeEntry{Name: commit.String(), Mode: filemode.Regular, Hash: blobHash})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	treeHash, err := storeObject(repository, &object.Tree{Entries: entries})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	notesHash, err := storeObject(repository, &object.Commit{
+		Author:       *signature,
+		Committer:    *signature,
+		Message:      "Notes added by image-updater",
+		TreeHash:     treeHash,
+		ParentHashes: parents,
+	})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if err := repository.Storer.SetReference(plumbing.NewHashReference(NotesRef, notesHash)); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	base := plumbing.ZeroHash
+	if len(parents) > 0 {
+		base = parents[0]
+	}
+	return base, nil
+}
+
+// setLeases writes the remote-tracking references that go-git compares the remote
+// references with when pushing with --force-with-lease. go-git only strips
+// refs/heads/ from the name of the pushed reference so the lease of a tag or of
+// the notes is looked up in refs/remotes/<remote>/refs/..., which a clone never
+// creates, and the push fails with "reference not found" without them.
+func setLeases(repository *git.Repository, remote string, leases map[plumbing.ReferenceName]plumbing.Hash) error {
+	for name, hash := range leases {
+		tracking := plumbing.ReferenceName("refs/remotes/" + remote + "/" + name.String())
+		if err := repository.Storer.SetReference(plumbing.NewHashReference(tracking, hash)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeObject encodes the object and writes it to the storer of the repository.
+func storeObject(repository *git.Repository, o interface {
+	Encode(plumbing.EncodedObject) error
+}) (plumbing.Hash, error) {
+	obj := repository.Storer.NewEncodedObject()
+	if err := o.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repository.Storer.SetEncodedObject(obj)
+}
+
+// updateFiles opens each file at the specified filepath, applies each of the
+// edits with yq and writes the file back to the worktree
+func (m *ImageUpdater) updateFiles(ctx context.Context, yq *dagger.Container, worktree *git.Worktree, files []string, edits []yqEdit) error {
 	for _, filePath := range files {
 		file, err := worktree.Filesystem.Open(filePath)
 		if err != nil {
@@ -163,8 +561,11 @@ func (m *ImageUpdater) updateFiles(ctx context.Context, yq *dagger.Container, wo
 			}).
 			WithoutEntrypoint().
 			With(func(c *dagger.Container) *dagger.Container {
-				for _, cid := range containers {
-					c = c.WithExec([]string{"sh", "-c", fmt.Sprintf("yq -i '.spec.template.spec.containers[%d].image = \"%s\"' deployment.yaml", cid, imageUrl)})
+				for _, edit := range edits {
+					c = c.
+						WithEnvVariable("KEY", edit.key).
+						WithEnvVariable("VALUE", edit.value).
+						WithExec([]string{"yq", "-i", edit.expression, "deployment.yaml"})
 				}
 				return c
 			}).
@@ -187,3 +588,128 @@ func (m *ImageUpdater) updateFiles(ctx context.Context, yq *dagger.Container, wo
 
 	return nil
 }
+
+// yqEdit is a yq expression that is applied to each of the files. The key and
+// value are exposed to the expression as the KEY and VALUE environment variables
+// so that they never have to be quoted.
+type yqEdit struct {
+	expression string
+	key        string
+	value      string
+}
+
+// imageEdits returns the list of edits that set the image on each of the containers
+// and the rendered labels, annotations and environment variables.
+func imageEdits(ref imageRef, containers []int, labels, annotations, envVars []string) ([]yqEdit, error) {
+	edits := []yqEdit{}
+	for _, cid := range containers {
+		edits = append(edits, yqEdit{
+			expression: fmt.Sprintf(".spec.template.spec.containers[%d].image = strenv(VALUE)", cid),
+			value:      ref.Image,
+		})
+	}
+
+	for _, metadata := range []struct {
+		field  string
+		values []string
+	}{
+		{field: "labels", values: labels},
+		{field: "annotations", values: annotations},
+	} {
+		kvs, err := renderKeyValues(metadata.values, ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			for _, path := range []string{".metadata", ".spec.template.metadata"} {
+				edits = append(edits, yqEdit{
+					expression: fmt.Sprintf("%s.%s += {strenv(KEY): strenv(VALUE)}", path, metadata.field),
+					key:        kv.key,
+					value:      kv.value,
+				})
+			}
+		}
+	}
+
+	kvs, err := renderKeyValues(envVars, ref)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		for _, cid := range containers {
+			edits = append(edits, yqEdit{
+				expression: fmt.Sprintf(`with(.spec.template.spec.containers[%d]; .env = ((.env // []) | map(select(.name != strenv(KEY)))) + [{"name": strenv(KEY), "value": strenv(VALUE)}])`, cid),
+				key:        kv.key,
+				value:      kv.value,
+			})
+		}
+	}
+
+	return edits, nil
+}
+
+// imageRef is the data that is available on the templates of labels, annotations
+// and environment variables.
+type imageRef struct {
+	// AppName is the name of the application that is being updated
+	AppName string
+	// Image is the full URL of the image
+	Image string
+	// Repository is the image URL without the tag and digest
+	Repository string
+	// Tag of the image, empty if the image has no tag
+	Tag string
+	// Digest of the image, empty if the image is not pinned by digest
+	Digest string
+}
+
+func newImageRef(appName, imageUrl string) imageRef {
+	ref := imageRef{AppName: appName, Image: imageUrl, Repository: imageUrl}
+	if i := strings.Index(ref.Repository, "@"); i >= 0 {
+		ref.Digest = ref.Repository[i+1:]
+		ref.Repository = ref.Repository[:i]
+	}
+	if i := strings.LastIndex(ref.Repository, ":"); i > strings.LastIndex(ref.Repository, "/") {
+		ref.Tag = ref.Repository[i+1:]
+		ref.Repository = ref.Repository[:i]
+	}
+	return ref
+}
+
+type keyValue struct {
+	key   string
+	value string
+}
+
+// renderKeyValues parses a list of key=value pairs rendering each of the values
+// as a template with the image ref.
+func renderKeyValues(pairs []string, ref imageRef) ([]keyValue, error) {
+	kvs := make([]keyValue, 0, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid key=value pair: %q", pair)
+		}
+
+		rendered, err := render(value, ref)
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, keyValue{key: key, value: rendered})
+	}
+	return kvs, nil
+}
+
+// render executes text as a template with the image ref as data.
+func render(text string, ref imageRef) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, ref); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"main/internal/dagger"
+	"strings"
+)
+
+// ConfigValue is a value of the stack configuration that is set before
+// running each command
+type ConfigValue struct {
+	// Key of the configuration, for example: aws:region
+	Key string
+	// Value of the configuration when it is not a secret
+	Value string
+	// Value of the configuration when it is a secret
+	Secret *dagger.Secret
+	// Whether the key is a path to a property of a structured value,
+	// for example: data.nested[0]
+	Path bool
+}
+
+// Sets a value of the stack configuration. The value is set with `pulumi config set`
+// on the selected stack before running each command
+func (m *Pulumi) WithConfig(
+	// Key of the configuration, for example: aws:region
+	key string,
+	// Value of the configuration
+	value string,
+	// Whether the key is a path to a property of a structured value, for example: data.nested[0]
+	// +optional
+	path bool,
+) *Pulumi {
+	m.ConfigValues = append(m.ConfigValues, &ConfigValue{
+		Key:   key,
+		Value: value,
+		Path:  path,
+	})
+	return m
+}
+
+// Sets a secret value of the stack configuration. The value is set with
+// `pulumi config set --secret` on the selected stack before running each command
+func (m *Pulumi) WithSecretConfig(
+	// Key of the configuration, for example: db:password
+	key string,
+	// Value of the configuration
+	value *dagger.Secret,
+	// Whether the key is a path to a property of a structured value, for example: data.nested[0]
+	// +optional
+	path bool,
+) *Pulumi {
+	m.ConfigValues = append(m.ConfigValues, &ConfigValue{
+		Key:    key,
+		Secret: value,
+		Path:   path,
+	})
+	return m
+}
+
+// Returns the configuration file of the stack after setting the values of
+// `with-config` and `with-secret-config`. Secret values are encrypted by the
+// secrets provider of the stack.
+func (m *Pulumi) Config(ctx context.Context, src *dagger.Directory, stack string) (*dagger.File, error) {
+	ct, err := m.authenticatedContainer(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	// The configuration file is named after the stack without its organization
+	// and project, for example: Pulumi.dev.yaml for org/project/dev
+	name := stack[strings.LastIndex(stack, "/")+1:]
+	return ct.
+		With(m.withConfig(stack)).
+		File(fmt.Sprintf("Pulumi.%s.yaml", name)), nil
+}
+
+// withConfig returns a function that sets the configuration values on the stack.
+// Secret values are mounted and piped to `pulumi config set` so that they never
+// show up in the arguments of the command.
+func (m *Pulumi) withConfig(stack string) dagger.WithContainerFunc {
+	return func(c *dagger.Container) *dagger.Container {
+		for i, config := range m.ConfigValues {
+			args := []string{"--stack", stack}
+			if config.Path {
+				args = append(args, "--path")
+			}
+
+			if config.Secret == nil {
+				args = append(args, "--", config.Key, config.Value)
+				c = c.WithExec(append([]string{"pulumi", "config", "set"}, args...))
+				continue
+			}
+
+			secretPath := fmt.Sprintf("/run/pulumi/config/%d", i)
+			args = append(args, "--secret", "--", config.Key)
+			c = c.
+				WithMountedSecret(secretPath, config.Secret).
+				WithExec(shell(`pulumi config set "${@:2}" < "$1"`, append([]string{secretPath}, args...)...))
+		}
+		return c
+	}
+}
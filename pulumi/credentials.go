@@ -0,0 +1,125 @@
+package main
+
+import "main/internal/dagger"
+
+// SecretEnv is an environment variable set from a secret
+type SecretEnv struct {
+	// Name of the environment variable
+	Name string
+	// Value of the environment variable
+	Value *dagger.Secret
+}
+
+// Sets the AWS session token of temporary credentials set with `with-aws-credentials`
+func (m *Pulumi) WithAwsSessionToken(token *dagger.Secret) *Pulumi {
+	m.AwsSessionToken = token
+	return m
+}
+
+// Sets the AWS shared credentials and config files and the profile to use from them
+func (m *Pulumi) WithAwsProfile(
+	// Name of the profile
+	profile string,
+	// Shared credentials file, usually ~/.aws/credentials
+	credentials *dagger.Secret,
+	// Shared config file, usually ~/.aws/config
+	// +optional
+	config *dagger.File,
+) *Pulumi {
+	m.AwsProfile = profile
+	m.AwsCredentialsFile = credentials
+	m.AwsConfigFile = config
+	return m
+}
+
+// Sets the kubeconfig used by the Kubernetes provider
+func (m *Pulumi) WithKubeconfig(kubeconfig *dagger.Secret) *Pulumi {
+	m.Kubeconfig = kubeconfig
+	return m
+}
+
+// Sets the GCP credentials used by the Google Cloud providers
+func (m *Pulumi) WithGcpCredentials(
+	// Service account key JSON
+	credentials *dagger.Secret,
+	// Default project of the resources
+	// +optional
+	project string,
+) *Pulumi {
+	m.GcpCredentials = credentials
+	m.GcpProject = project
+	return m
+}
+
+// Sets the Azure service principal used by the Azure providers
+func (m *Pulumi) WithAzureCredentials(
+	// Client ID of the service principal
+	clientId string,
+	// Client secret of the service principal
+	clientSecret *dagger.Secret,
+	// ID of the tenant
+	tenantId string,
+	// ID of the subscription
+	subscriptionId string,
+) *Pulumi {
+	m.AzureClientId = clientId
+	m.AzureClientSecret = clientSecret
+	m.AzureTenantId = tenantId
+	m.AzureSubscriptionId = subscriptionId
+	return m
+}
+
+// Sets an environment variable from a secret, for example the credentials of
+// a provider that has no dedicated function
+func (m *Pulumi) WithSecretEnv(name string, value *dagger.Secret) *Pulumi {
+	m.SecretEnvs = append(m.SecretEnvs, &SecretEnv{
+		Name:  name,
+		Value: value,
+	})
+	return m
+}
+
+// withCredentials sets the credentials of every provider that was configured.
+func (m *Pulumi) withCredentials(ct *dagger.Container) *dagger.Container {
+	if m.AwsAccessKey != nil && m.AwsSecretKey != nil {
+		ct = ct.WithSecretVariable("AWS_ACCESS_KEY_ID", m.AwsAccessKey).
+			WithSecretVariable("AWS_SECRET_ACCESS_KEY", m.AwsSecretKey)
+	}
+	if m.AwsSessionToken != nil {
+		ct = ct.WithSecretVariable("AWS_SESSION_TOKEN", m.AwsSessionToken)
+	}
+	if m.AwsCredentialsFile != nil {
+		ct = ct.WithMountedSecret("/root/.aws/credentials", m.AwsCredentialsFile).
+			WithEnvVariable("AWS_SHARED_CREDENTIALS_FILE", "/root/.aws/credentials").
+			WithEnvVariable("AWS_PROFILE", m.AwsProfile)
+	}
+	if m.AwsConfigFile != nil {
+		ct = ct.WithMountedFile("/root/.aws/config", m.AwsConfigFile).
+			WithEnvVariable("AWS_CONFIG_FILE", "/root/.aws/config")
+	}
+
+	if m.Kubeconfig != nil {
+		ct = ct.WithMountedSecret("/root/.kube/config", m.Kubeconfig).
+			WithEnvVariable("KUBECONFIG", "/root/.kube/config")
+	}
+
+	if m.GcpCredentials != nil {
+		ct = ct.WithMountedSecret("/root/.config/gcloud/credentials.json", m.GcpCredentials).
+			WithEnvVariable("GOOGLE_APPLICATION_CREDENTIALS", "/root/.config/gcloud/credentials.json")
+	}
+	if m.GcpProject != "" {
+		ct = ct.WithEnvVariable("GOOGLE_PROJECT", m.GcpProject)
+	}
+
+	if m.AzureClientSecret != nil {
+		ct = ct.WithEnvVariable("ARM_CLIENT_ID", m.AzureClientId).
+			WithSecretVariable("ARM_CLIENT_SECRET", m.AzureClientSecret).
+			WithEnvVariable("ARM_TENANT_ID", m.AzureTenantId).
+			WithEnvVariable("ARM_SUBSCRIPTION_ID", m.AzureSubscriptionId)
+	}
+
+	for _, env := range m.SecretEnvs {
+		ct = ct.WithSecretVariable(env.Name, env.Value)
+	}
+	return ct
+}
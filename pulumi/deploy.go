@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"main/internal/dagger"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// stackReferencePattern matches the name passed to a StackReference in the
+// programs of every runtime, for example:
+// pulumi.NewStackReference(ctx, "org/network/dev", nil) in go or
+// new pulumi.StackReference(`org/network/${pulumi.getStack()}`) in nodejs
+var stackReferencePattern = regexp.MustCompile("StackReference\\b[^\"'`\\n]*[\"'`]([^\"'`\\n]+)[\"'`]")
+
+// stackReferenceSources are the files of the programs that are searched for StackReferences
+var stackReferenceSources = []string{"**/*.go", "**/*.ts", "**/*.js", "**/*.py", "**/*.cs", "**/*.java"}
+
+// Deployment is a stack of a project that is deployed by `up-all`
+type Deployment struct {
+	// Path of the project relative to the source directory
+	Project string
+	// Name of the stack
+	Stack string
+	// Deployments that must succeed before this one, as <project>:<stack>
+	DependsOn []string
+}
+
+// DeploymentResult is the result of the deployment of a stack
+type DeploymentResult struct {
+	// Path of the project relative to the source directory
+	Project string
+	// Name of the stack
+	Stack string
+	// Status of the deployment: succeeded, failed or skipped
+	Status string
+	// Output of `pulumi up`
+	Output string
+	// Why the deployment failed or was skipped
+	Error string
+}
+
+// Adds a stack to the deployments run by `up-all`
+func (m *Pulumi) WithDeployment(
+	// Path of the project relative to the source directory, "." for the root project
+	project string,
+	// Name of the stack
+	stack string,
+	// Deployments that must succeed before this one, as <project>:<stack>,
+	// for example: infra/network:dev
+	// +optional
+	dependsOn []string,
+) *Pulumi {
+	m.Deployments = append(m.Deployments, &Deployment{
+		Project:   path.Clean(project),
+		Stack:     stack,
+		DependsOn: dependsOn,
+	})
+	return m
+}
+
+// Runs `pulumi up` for every stack added with `with-deployment` in the order of
+// their dependencies. Independent stacks are deployed in parallel and the stacks
+// that depend on one that failed are skipped.
+// NOTE: This command will perform changes in your cloud
+func (m *Pulumi) UpAll(ctx context.Context, src *dagger.Directory,
+	// Also infer the dependencies from the StackReferences of the programs.
+	// Only references with a literal project name are found, when the stack
+	// name is not literal it is assumed to be the same stack
+	// +optional
+	inferDependencies bool,
+) ([]*DeploymentResult, error) {
+	deps, err := m.deploymentDependencies(ctx, src, inferDependencies)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCycles(deps); err != nil {
+		return nil, err
+	}
+
+	// Each deployment waits for its dependencies to be done before reading
+	// their results
+	results := make(map[string]*DeploymentResult, len(m.Deployments))
+	done := make(map[string]chan struct{}, len(m.Deployments))
+	for _, d := range m.Deployments {
+		results[d.key()] = &DeploymentResult{Project: d.Project, Stack: d.Stack}
+		done[d.key()] = make(chan struct{})
+	}
+
+	wg := sync.WaitGroup{}
+	for _, d := range m.Deployments {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[d.key()])
+
+			res := results[d.key()]
+			for _, dep := range deps[d.key()] {
+				<-done[dep]
+				if results[dep].Status != "succeeded" {
+					res.Status = "skipped"
+					res.Error = fmt.Sprintf("dependency %s %s", dep, results[dep].Status)
+					return
+				}
+			}
+
+			p := *m
+			if _, err := p.WithProjectPath(d.Project); err != nil {
+				res.Status, res.Error = "failed", err.Error()
+				return
+			}
+			out, err := p.Up(ctx, src, d.Stack, nil, nil, nil, nil, false)
+			if err != nil {
+				res.Status, res.Error = "failed", err.Error()
+				return
+			}
+			res.Status, res.Output = "succeeded", out
+		}()
+	}
+	wg.Wait()
+
+	ordered := []*DeploymentResult{}
+	for _, d := range m.Deployments {
+		ordered = append(ordered, results[d.key()])
+	}
+	return ordered, nil
+}
+
+// key returns the identifier of the deployment used by DependsOn.
+func (d *Deployment) key() string {
+	return d.Project + ":" + d.Stack
+}
+
+// deploymentDependencies returns the keys of the dependencies of each deployment.
+func (m *Pulumi) deploymentDependencies(ctx context.Context, src *dagger.Directory, infer bool) (map[string][]string, error) {
+	deps := map[string][]string{}
+	for _, d := range m.Deployments {
+		if _, ok := deps[d.key()]; ok {
+			return nil, fmt.Errorf("deployment %s is added more than once", d.key())
+		}
+		deps[d.key()] = []string{}
+	}
+
+	for _, d := range m.Deployments {
+		for _, dep := range d.DependsOn {
+			project, stack, ok := strings.Cut(dep, ":")
+			if !ok {
+				return nil, fmt.Errorf("dependency of %s must be <project>:<stack>: %s", d.key(), dep)
+			}
+			dep = path.Clean(project) + ":" + stack
+			if _, ok := deps[dep]; !ok {
+				return nil, fmt.Errorf("dependency %s of %s is not a deployment", dep, d.key())
+			}
+			if !slices.Contains(deps[d.key()], dep) {
+				deps[d.key()] = append(deps[d.key()], dep)
+			}
+		}
+	}
+
+	if !infer {
+		return deps, nil
+	}
+
+	// StackReferences use the names of the projects instead of their paths
+	names := map[string]string{}
+	for _, d := range m.Deployments {
+		p, err := readProject(ctx, src.Directory(d.Project))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d.Project, err)
+		}
+		names[d.Project] = p.Name
+	}
+
+	for _, d := range m.Deployments {
+		refs, err := stackReferences(ctx, src.Directory(d.Project))
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			project, stack := parseStackReference(ref)
+			if project == "" {
+				continue
+			}
+			if stack == "" {
+				stack = d.Stack
+			}
+
+			for _, dep := range m.Deployments {
+				if names[dep.Project] == project && stackName(dep.Stack) == stack && dep != d &&
+					!slices.Contains(deps[d.key()], dep.key()) {
+					deps[d.key()] = append(deps[d.key()], dep.key())
+				}
+			}
+		}
+	}
+	return deps, nil
+}
+
+// stackReferences returns the names passed to the StackReferences of the program.
+func stackReferences(ctx context.Context, dir *dagger.Directory) ([]string, error) {
+	refs := []string{}
+	for _, pattern := range stackReferenceSources {
+		files, err := dir.Glob(ctx, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if skipProjectDir(path.Dir(file)) {
+				continue
+			}
+			contents, err := dir.File(file).Contents(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, match := range stackReferencePattern.FindAllStringSubmatch(contents, -1) {
+				refs = append(refs, match[1])
+			}
+		}
+	}
+	return refs, nil
+}
+
+// parseStackReference returns the project and the stack of a stack reference
+// name, which has the format [<org>/]<project>/<stack>. The project is empty if
+// the name doesn't have a literal one and the stack is empty if it isn't literal.
+func parseStackReference(name string) (string, string) {
+	parts := strings.Split(name, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", ""
+	}
+
+	literal := func(s string) bool {
+		return s != "" && !strings.ContainsAny(s, "${}+%")
+	}
+
+	project, stack := parts[len(parts)-2], parts[len(parts)-1]
+	if !literal(project) {
+		return "", ""
+	}
+	if !literal(stack) {
+		stack = ""
+	}
+	return project, stack
+}
+
+// stackName returns the name of the stack without its organization and project.
+func stackName(stack string) string {
+	return stack[strings.LastIndex(stack, "/")+1:]
+}
+
+// checkCycles returns an error if the dependencies have a cycle.
+func checkCycles(deps map[string][]string) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+
+	var visit func(key string, chain []string) error
+	visit = func(key string, chain []string) error {
+		switch state[key] {
+		case visiting:
+			return errors.New("deployments have a dependency cycle: " + strings.Join(append(chain, key), " -> "))
+		case visited:
+			return nil
+		}
+
+		state[key] = visiting
+		for _, dep := range deps[key] {
+			if err := visit(dep, append(chain, key)); err != nil {
+				return err
+			}
+		}
+		state[key] = visited
+		return nil
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(deps)) {
+		if err := visit(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
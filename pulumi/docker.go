@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"main/internal/dagger"
+	"net"
+)
+
+const (
+	// dockerConfigPath is where the Docker config file that points the registries
+	// to the credential helper is written
+	dockerConfigPath = "/root/.docker/config.json"
+	// credentialHelperPath is where the credential helper is installed, the
+	// Docker config file refers to it by the suffix of its name
+	credentialHelperPath = "/usr/local/bin/docker-credential-pulumi"
+	// registryAuthsDir is where the address, username and password of each
+	// registry are mounted for the credential helper
+	registryAuthsDir = "/run/pulumi/registries"
+)
+
+// credentialHelper is a Docker credential helper that returns the credentials of
+// the registries from the files mounted on registryAuthsDir. Storing and erasing
+// credentials are no-ops since they are only set with with-registry-auth.
+const credentialHelper = `#!/bin/bash
+set -e
+escape() { sed -e 's/\\/\\\\/g' -e 's/"/\\"/g' | tr -d '\n'; }
+case "$1" in
+get)
+	# The server is written without a trailing newline so read returns an error
+	read -r server || true
+	for dir in ` + registryAuthsDir + `/*/; do
+		if [ "$(cat "$dir/address")" = "$server" ]; then
+			printf '{"ServerURL":"%s","Username":"%s","Secret":"%s"}\n' \
+				"$(escape < "$dir/address")" "$(escape < "$dir/username")" "$(escape < "$dir/password")"
+			exit 0
+		fi
+	done
+	echo "credentials not found in native keychain"
+	exit 1
+	;;
+list)
+	echo "{}"
+	;;
+esac
+`
+
+// RegistryAuth is the credentials of a container registry used by the Docker provider
+type RegistryAuth struct {
+	// Address of the registry, for example: ghcr.io
+	Address string
+	// Username of the registry
+	Username string
+	// Password or token of the registry
+	Secret *dagger.Secret
+}
+
+// Sets the credentials of a container registry, which the Docker provider gets
+// from a credential helper set on the Docker config file of the Pulumi container
+func (m *Pulumi) WithRegistryAuth(
+	// Address of the registry, for example: ghcr.io
+	address string,
+	// Username of the registry
+	username string,
+	// Password or token of the registry
+	secret *dagger.Secret,
+) *Pulumi {
+	m.RegistryAuths = append(m.RegistryAuths, &RegistryAuth{
+		Address:  address,
+		Username: username,
+		Secret:   secret,
+	})
+	return m
+}
+
+// Binds a registry service, for example a registry:2 container, so that images
+// can be pushed to it without network access. Images are pushed to it by naming
+// them after its address, for example: registry:5000/app. The Docker Engine
+// created by `with-docker` trusts the registry even though it doesn't use TLS,
+// an engine passed to `with-docker` has to be set up to reach it.
+func (m *Pulumi) WithRegistry(
+	// Registry service
+	service *dagger.Service,
+	// Address of the registry, the host is used as the alias of the service
+	// +optional
+	// +default="registry:5000"
+	address string,
+) (*Pulumi, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("registry address must be <host>:<port>: %w", err)
+	}
+
+	m.Registry = service
+	m.RegistryAddress = address
+	return m, nil
+}
+
+// withDocker binds the Docker Engine and the registry, if any, and sets up the
+// credentials of the registries.
+func (m *Pulumi) withDocker(ct *dagger.Container) *dagger.Container {
+	if m.Registry != nil {
+		ct = ct.WithServiceBinding(m.registryHost(), m.Registry)
+	}
+
+	if len(m.RegistryAuths) > 0 {
+		ct = ct.With(m.withDockerConfig)
+	}
+
+	if !m.Docker {
+		return ct
+	}
+	return ct.
+		WithEnvVariable("DOCKER_HOST", "tcp://docker:2375").
+		WithServiceBinding("docker", m.dockerEngine())
+}
+
+// dockerEngine returns the Docker Engine service bound to the Pulumi container.
+func (m *Pulumi) dockerEngine() *dagger.Service {
+	switch {
+	case m.DockerEngine != nil:
+		return m.DockerEngine
+	case m.Registry != nil:
+		// The engine is the one that pushes the images so it needs to reach
+		// the registry and to be told to trust it without TLS
+		image := "docker:dind"
+		if m.DockerVersion != "" {
+			image = fmt.Sprintf("docker:%s-dind", m.DockerVersion)
+		}
+		return dag.
+			Container().
+			From(image).
+			WithEnvVariable("DOCKER_TLS_CERTDIR", "").
+			WithServiceBinding(m.registryHost(), m.Registry).
+			WithExposedPort(2375).
+			AsService(dagger.ContainerAsServiceOpts{
+				Args:                     []string{"dockerd", "--host=tcp://0.0.0.0:2375", "--tls=false", "--insecure-registry=" + m.RegistryAddress},
+				UseEntrypoint:            true,
+				InsecureRootCapabilities: true,
+			})
+	default:
+		return dag.Docker().Engine(dagger.DockerEngineOpts{
+			Version: m.DockerVersion,
+		})
+	}
+}
+
+// registryHost returns the host of the registry address, which is used as the
+// alias of the registry service.
+func (m *Pulumi) registryHost() string {
+	host, _, _ := net.SplitHostPort(m.RegistryAddress)
+	return host
+}
+
+// withDockerConfig writes a Docker config file that gets the credentials of the
+// registries from a credential helper. The passwords are only mounted as secrets
+// so that they are never written to the filesystem of the container.
+func (m *Pulumi) withDockerConfig(ct *dagger.Container) *dagger.Container {
+	helpers := map[string]string{}
+	for i, registry := range m.RegistryAuths {
+		dir := fmt.Sprintf("%s/%d", registryAuthsDir, i)
+		ct = ct.
+			WithNewFile(dir+"/address", registry.Address).
+			WithNewFile(dir+"/username", registry.Username).
+			WithMountedSecret(dir+"/password", registry.Secret)
+		helpers[registry.Address] = "pulumi"
+	}
+
+	config, _ := json.Marshal(map[string]any{"credHelpers": helpers})
+	return ct.
+		WithNewFile(credentialHelperPath, credentialHelper, dagger.ContainerWithNewFileOpts{
+			Permissions: 0o755,
+		}).
+		WithNewFile(dockerConfigPath, string(config))
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"main/internal/dagger"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// secretSig is the key that Pulumi uses to mark secret values in the state
+const secretSig = "4dabf18193072939515e22adb298388d"
+
+// DriftResult is the verdict of a drift detection
+type DriftResult struct {
+	// Whether any resource drifted
+	Drifted bool
+	// Resources that drifted
+	Resources []*DriftedResource
+}
+
+// DriftedResource is a resource whose actual state differs from the expected one
+type DriftedResource struct {
+	// URN of the resource
+	Urn string
+	// Type of the resource, for example: aws:s3/bucket:Bucket
+	Type string
+	// Operation that would reconcile the resource, for example: update or delete
+	Operation string
+	// Properties that changed
+	Diffs []*PropertyDiff
+}
+
+// PropertyDiff is a change of a property of a resource
+type PropertyDiff struct {
+	// Path of the property, for example: tags.Name
+	Path string
+	// Kind of change: add, delete or update, with a -replace suffix if the
+	// change requires a replacement
+	Kind string
+	// JSON encoded value before the change, secrets are redacted
+	Old string
+	// JSON encoded value after the change, secrets are redacted
+	New string
+}
+
+// Detects whether the resources of the stack drifted returning a verdict that
+// can be used by schedulers to alert only on real drift. By default the stack
+// is compared with the actual state of the cloud by running
+// `pulumi refresh --preview-only`. Nothing is changed on the stack or the cloud.
+func (m *Pulumi) DetectDrift(ctx context.Context, src *dagger.Directory, stack string,
+	// Compare the program with the stack instead, by running `pulumi preview`,
+	// to detect changes that were not deployed
+	// +optional
+	program bool,
+) (*DriftResult, error) {
+	args := []string{"refresh", "--preview-only"}
+	if program {
+		args = []string{"preview"}
+	}
+
+	digest, err := m.digest(ctx, src, stack, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &DriftResult{Resources: []*DriftedResource{}}
+	for _, step := range digest.Steps {
+		if !step.changed() {
+			continue
+		}
+		res.Resources = append(res.Resources, &DriftedResource{
+			Urn:       step.Urn,
+			Type:      step.resourceType(),
+			Operation: step.Op,
+			Diffs:     step.propertyDiffs(),
+		})
+	}
+	res.Drifted = len(res.Resources) > 0
+	return res, nil
+}
+
+// changed returns whether the step would change the resource. Refresh steps
+// are reported for every resource so they only count if a property changed.
+func (s previewStep) changed() bool {
+	switch s.Op {
+	case "same":
+		return false
+	case "refresh":
+		return len(s.DetailedDiff) > 0 || len(s.DiffReasons) > 0
+	default:
+		return true
+	}
+}
+
+// propertyDiffs returns the changes of the properties of the step with their
+// values before and after the change.
+func (s previewStep) propertyDiffs() []*PropertyDiff {
+	diffs := []*PropertyDiff{}
+	if len(s.DetailedDiff) == 0 {
+		// Providers that don't support detailed diffs only report the
+		// top-level properties that changed
+		for _, reason := range s.DiffReasons {
+			diffs = append(diffs, s.propertyDiff(reason, propertyDiff{Kind: "update", InputDiff: true}))
+		}
+		return diffs
+	}
+
+	for _, path := range slices.Sorted(maps.Keys(s.DetailedDiff)) {
+		diffs = append(diffs, s.propertyDiff(path, s.DetailedDiff[path]))
+	}
+	return diffs
+}
+
+func (s previewStep) propertyDiff(path string, diff propertyDiff) *PropertyDiff {
+	return &PropertyDiff{
+		Path: path,
+		Kind: string(diff.Kind),
+		Old:  stateValue(s.OldState, path, diff.InputDiff),
+		New:  stateValue(s.NewState, path, diff.InputDiff),
+	}
+}
+
+// stateValue returns the JSON encoded value of the property at the path of the
+// inputs or outputs of the state with its secrets redacted. It is empty if the
+// property does not exist.
+func stateValue(state *resourceState, path string, input bool) string {
+	if state == nil {
+		return ""
+	}
+
+	props := state.Outputs
+	if input {
+		props = state.Inputs
+	}
+
+	v, ok := lookupPath(props, path)
+	if !ok {
+		return ""
+	}
+
+	b, err := json.Marshal(redact(v))
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// lookupPath returns the value at the property path, for example:
+// ingress[0].cidrBlocks or tags["kubernetes.io/name"].
+func lookupPath(v any, path string) (any, bool) {
+	for path != "" {
+		switch {
+		case path[0] == '.':
+			path = path[1:]
+			continue
+		case strings.HasPrefix(path, `["`):
+			end := strings.Index(path, `"]`)
+			if end < 0 {
+				return nil, false
+			}
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			v, ok = m[path[2:end]]
+			if !ok {
+				return nil, false
+			}
+			path = path[end+2:]
+		case path[0] == '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return nil, false
+			}
+			i, err := strconv.Atoi(path[1:end])
+			if err != nil {
+				return nil, false
+			}
+			l, ok := v.([]any)
+			if !ok || i < 0 || i >= len(l) {
+				return nil, false
+			}
+			v = l[i]
+			path = path[end+1:]
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			v, ok = m[path[:end]]
+			if !ok {
+				return nil, false
+			}
+			path = path[end:]
+		}
+
+		// Secret values wrap the actual value so the rest of the
+		// path can't be followed
+		if isSecret(v) {
+			return v, true
+		}
+	}
+	return v, true
+}
+
+// redact replaces every secret value with [secret].
+func redact(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		if isSecret(t) {
+			return "[secret]"
+		}
+		redacted := make(map[string]any, len(t))
+		for k, e := range t {
+			redacted[k] = redact(e)
+		}
+		return redacted
+	case []any:
+		redacted := make([]any, len(t))
+		for i, e := range t {
+			redacted[i] = redact(e)
+		}
+		return redacted
+	default:
+		return v
+	}
+}
+
+func isSecret(v any) bool {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return false
+	}
+	_, ok = m[secretSig]
+	return ok
+}
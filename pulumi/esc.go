@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"main/internal/dagger"
+	"maps"
+	"slices"
+	"time"
+)
+
+const (
+	escInstallCmd = "curl -fsSL https://get.pulumi.com/esc/install.sh | sh"
+	escBin        = "/root/.pulumi/bin/esc"
+	escFilesDir   = "/root/.esc/files"
+)
+
+// escValues are the values of an opened ESC environment that are exported
+// into the container.
+type escValues struct {
+	EnvironmentVariables map[string]any `json:"environmentVariables"`
+	Files                map[string]any `json:"files"`
+}
+
+// withEsc opens the ESC environment and exports its environment variables and
+// files into the container like `esc run` does: variables are set on the
+// container and files are mounted with a variable pointing to their path.
+// Every value is set as a secret so that it is masked on the output of
+// the commands.
+func (m *Pulumi) withEsc(ctx context.Context, ct *dagger.Container) (*dagger.Container, error) {
+	// The environment is written to a file instead of stdout so that the
+	// resolved values don't show up in the logs. The environment is opened on
+	// every call since values such as OIDC credentials are short lived.
+	contents, err := ct.
+		WithExec(shell(escInstallCmd)).
+		With(withCacheBust).
+		WithExec([]string{escBin, "env", "open", m.EscEnv, "--format", "json"}, dagger.ContainerWithExecOpts{
+			RedirectStdout: "/tmp/esc.json",
+		}).
+		File("/tmp/esc.json").
+		Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	values := escValues{}
+	if err := json.Unmarshal([]byte(contents), &values); err != nil {
+		return nil, fmt.Errorf("failed to parse ESC environment %s: %w", m.EscEnv, err)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(values.EnvironmentVariables)) {
+		ct = ct.WithSecretVariable(name, escSecret(name, values.EnvironmentVariables[name]))
+	}
+	for _, name := range slices.Sorted(maps.Keys(values.Files)) {
+		path := escFilesDir + "/" + name
+		ct = ct.
+			WithMountedSecret(path, escSecret(name, values.Files[name])).
+			WithEnvVariable(name, path)
+	}
+	return ct, nil
+}
+
+// escSecret creates a secret with the value of the ESC environment. The name of
+// the secret is unique to each call since values such as OIDC credentials
+// change between calls.
+func escSecret(name string, value any) *dagger.Secret {
+	plaintext, ok := value.(string)
+	if !ok {
+		plaintext = fmt.Sprint(value)
+	}
+	return dag.SetSecret(fmt.Sprintf("esc-%s-%d", name, time.Now().UnixNano()), plaintext)
+}
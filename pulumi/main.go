@@ -5,10 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"main/internal/dagger"
-
-	"gopkg.in/yaml.v3"
+	neturl "net/url"
+	"path"
+	"strings"
+	"time"
 )
 
+// PlanPath is where update plans are saved and mounted in the Pulumi container
+const PlanPath = "/tmp/pulumi-plan.json"
+
 type Pulumi struct {
 	// +private
 	AwsAccessKey *dagger.Secret
@@ -22,6 +27,84 @@ type Pulumi struct {
 	Version string
 	// Whether a Docker Engine will be bound to the Pulumi container
 	Docker bool
+	// +private
+	DockerEngine *dagger.Service
+	// The version of the Docker Engine
+	DockerVersion string
+	// +private
+	Registry *dagger.Service
+	// The address of the registry service, for example: registry:5000
+	RegistryAddress string
+	// +private
+	RegistryAuths []*RegistryAuth
+	// The path of the Pulumi project relative to the source directory
+	ProjectPath string
+	// The URL of the self-managed state backend. Pulumi Cloud is used when empty
+	BackendUrl string
+	// +private
+	BackendState *dagger.CacheVolume
+	// +private
+	BackendService *dagger.Service
+	// +private
+	BackendAccessKey *dagger.Secret
+	// +private
+	BackendSecretKey *dagger.Secret
+	// +private
+	BackendCredentials *dagger.Secret
+	// +private
+	Passphrase *dagger.Secret
+	// +private
+	Plugins []*Plugin
+	// +private
+	ConfigValues []*ConfigValue
+	// +private
+	AwsSessionToken *dagger.Secret
+	// +private
+	AwsProfile string
+	// +private
+	AwsCredentialsFile *dagger.Secret
+	// +private
+	AwsConfigFile *dagger.File
+	// +private
+	Kubeconfig *dagger.Secret
+	// +private
+	GcpCredentials *dagger.Secret
+	// +private
+	GcpProject string
+	// +private
+	AzureClientId string
+	// +private
+	AzureClientSecret *dagger.Secret
+	// +private
+	AzureTenantId string
+	// +private
+	AzureSubscriptionId string
+	// +private
+	SecretEnvs []*SecretEnv
+	// +private
+	PolicyPacks []*PolicyPack
+	// +private
+	Deployments []*Deployment
+}
+
+// Plugin is a Pulumi plugin that is installed before running commands
+type Plugin struct {
+	// Kind of the plugin, for example: resource
+	Kind string
+	// Name of the plugin, for example: aws
+	Name string
+	// Version of the plugin, for example: 6.66.0
+	Version string
+	// URL of the server the plugin is downloaded from
+	Server string
+}
+
+// PlannedPreview is the output of a preview together with the update plan it saved
+type PlannedPreview struct {
+	// Output of the diff of the preview
+	Output string
+	// Update plan to pass to `up`
+	Plan *dagger.File
 }
 
 // Optional function to specify the version of Pulumi's docker image to use as base
@@ -30,6 +113,22 @@ func (m *Pulumi) FromVersion(version string) *Pulumi {
 	return m
 }
 
+// Sets the path of the Pulumi project relative to the source directory, for
+// example infra/network in a monorepo. The whole source directory is still
+// mounted so that the project can use local packages of sibling directories.
+func (m *Pulumi) WithProjectPath(projectPath string) (*Pulumi, error) {
+	projectPath = path.Clean(projectPath)
+	if path.IsAbs(projectPath) || projectPath == ".." || strings.HasPrefix(projectPath, "../") {
+		return nil, fmt.Errorf("project path must be relative to the source directory: %s", projectPath)
+	}
+	if projectPath == "." {
+		projectPath = ""
+	}
+
+	m.ProjectPath = projectPath
+	return m, nil
+}
+
 // Sets the AWS credentials to be used by Pulumi
 // Call this function if you want pulumi to point your changes to AWS
 func (m *Pulumi) WithAwsCredentials(awsAccessKey, awsSecretKey *dagger.Secret) *Pulumi {
@@ -38,7 +137,9 @@ func (m *Pulumi) WithAwsCredentials(awsAccessKey, awsSecretKey *dagger.Secret) *
 	return m
 }
 
-// Use Pulumi ESC as the provider of AWS OIDC credentials
+// Use a Pulumi ESC environment, for example as the provider of AWS OIDC credentials.
+// The environment variables and files of the environment are exported into the
+// container where the commands run, like `esc run` does. Requires a Pulumi token
 func (m *Pulumi) WithEsc(env string) *Pulumi {
 	m.EscEnv = env
 	return m
@@ -50,66 +151,309 @@ func (m *Pulumi) WithPulumiToken(pulumiToken *dagger.Secret) *Pulumi {
 	return m
 }
 
-// Sets up the Pulumi container with a Docker Engine Service container
-func (m *Pulumi) WithDocker() *Pulumi {
+// Use a self-managed state backend instead of Pulumi Cloud, no Pulumi token is
+// required when a backend is set. Supported URLs are file://, s3://, gs:// and azblob://.
+// S3-compatible storage such as MinIO is supported by setting the endpoint on the URL,
+// for example: s3://state?endpoint=minio:9000&disableSSL=true&s3ForcePathStyle=true&region=us-east-1
+// The state of a file:// backend is persisted in a cache volume only, a directory
+// isn't supported since the changes made to it by the commands would be lost.
+func (m *Pulumi) WithBackend(
+	// URL of the backend
+	url string,
+	// Cache volume where the state of a file:// backend is persisted. Defaults to
+	// a cache volume named after the path of the URL
+	// +optional
+	state *dagger.CacheVolume,
+	// Service that serves the backend, for example a MinIO server. It is bound to
+	// the Pulumi container using the host of the endpoint on the URL
+	// +optional
+	service *dagger.Service,
+	// Access key ID for s3:// backends or storage account name for azblob:// backends
+	// +optional
+	accessKey *dagger.Secret,
+	// Secret access key for s3:// backends or storage account key for azblob:// backends
+	// +optional
+	secretKey *dagger.Secret,
+	// Service account key JSON for gs:// backends
+	// +optional
+	credentials *dagger.Secret,
+) (*Pulumi, error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		if !path.IsAbs(u.Path) {
+			return nil, fmt.Errorf("file backend path must be absolute: %s", url)
+		}
+		if state == nil {
+			state = dag.CacheVolume("pulumi-state-" + u.Path)
+		}
+	case "s3", "gs", "azblob":
+	default:
+		return nil, fmt.Errorf("unsupported pulumi backend: %s", url)
+	}
+
+	if service != nil && backendHost(u) == "" {
+		return nil, errors.New("a backend service requires an endpoint on the backend URL")
+	}
+
+	m.BackendUrl = url
+	m.BackendState = state
+	m.BackendService = service
+	m.BackendAccessKey = accessKey
+	m.BackendSecretKey = secretKey
+	m.BackendCredentials = credentials
+	return m, nil
+}
+
+// Sets the passphrase used by the default secrets provider of self-managed backends
+func (m *Pulumi) WithPassphrase(passphrase *dagger.Secret) *Pulumi {
+	m.Passphrase = passphrase
+	return m
+}
+
+// Installs a pinned version of a plugin before running commands. Plugins are
+// stored in a cache volume so once the cache is warm they are not downloaded again.
+func (m *Pulumi) WithPlugin(
+	// Kind of the plugin, for example: resource
+	kind string,
+	// Name of the plugin, for example: aws
+	name string,
+	// Version of the plugin, for example: 6.66.0
+	version string,
+	// URL of the server the plugin is downloaded from
+	// +optional
+	server string,
+) *Pulumi {
+	m.Plugins = append(m.Plugins, &Plugin{
+		Kind:    kind,
+		Name:    name,
+		Version: version,
+		Server:  server,
+	})
+	return m
+}
+
+// Sets up the Pulumi container with a Docker Engine Service container, which is
+// reachable at tcp://docker:2375
+func (m *Pulumi) WithDocker(
+	// Docker Engine to use instead of a new one. It must listen on port 2375 without TLS
+	// +optional
+	engine *dagger.Service,
+	// Version of the new Docker Engine, for example: 27.3
+	// +optional
+	version string,
+) *Pulumi {
 	m.Docker = true
+	m.DockerEngine = engine
+	m.DockerVersion = version
 	return m
 }
 
 // Runs the `pulumi up` command for the given stack and directory
 // NOTE: This command will perform changes in your cloud
-func (m *Pulumi) Up(ctx context.Context, src *dagger.Directory, stack string) (string, error) {
-	return m.commandOutput(ctx, src, fmt.Sprintf("pulumi up --stack %s --yes --non-interactive", stack))
+func (m *Pulumi) Up(ctx context.Context, src *dagger.Directory, stack string,
+	// Plan saved by `preview-plan`. When specified the update fails if it would
+	// perform changes that are not part of the plan
+	// +optional
+	plan *dagger.File,
+	// URNs of the only resources to update
+	// +optional
+	target []string,
+	// URNs of resources to leave out of the update
+	// +optional
+	exclude []string,
+	// URNs of resources to replace
+	// +optional
+	replace []string,
+	// Also update the resources that depend on the targets
+	// +optional
+	targetDependents bool,
+) (string, error) {
+	targets := targetOptions{target: target, exclude: exclude, replace: replace, targetDependents: targetDependents}
+	if err := m.validateTargets(ctx, src, stack, targets); err != nil {
+		return "", err
+	}
+
+	args := append([]string{"up", "--stack", stack, "--yes", "--non-interactive"}, targets.args()...)
+	args = append(args, m.policyArgs()...)
+	if plan == nil {
+		return m.engineOutput(ctx, src, args, m.withConfig(stack))
+	}
+
+	return m.engineOutput(ctx, src, append(args, "--plan", PlanPath), m.withConfig(stack), func(c *dagger.Container) *dagger.Container {
+		return c.
+			WithEnvVariable("PULUMI_EXPERIMENTAL", "true").
+			WithMountedFile(PlanPath, plan)
+	})
 }
 
 // Runs the `pulumi preview` command for the given stack and directory
 // returning the output of the diff that was generated.
-func (m *Pulumi) Preview(ctx context.Context, src *dagger.Directory, stack string) (string, error) {
-	return m.commandOutput(ctx, src, fmt.Sprintf("pulumi preview --stack %s --non-interactive --diff", stack))
+func (m *Pulumi) Preview(ctx context.Context, src *dagger.Directory, stack string,
+	// URNs of the only resources to preview
+	// +optional
+	target []string,
+	// URNs of resources to leave out of the preview
+	// +optional
+	exclude []string,
+	// URNs of resources to replace
+	// +optional
+	replace []string,
+	// Also preview the resources that depend on the targets
+	// +optional
+	targetDependents bool,
+) (string, error) {
+	targets := targetOptions{target: target, exclude: exclude, replace: replace, targetDependents: targetDependents}
+	if err := m.validateTargets(ctx, src, stack, targets); err != nil {
+		return "", err
+	}
+
+	args := append([]string{"preview", "--stack", stack, "--non-interactive", "--diff"}, targets.args()...)
+	return m.engineOutput(ctx, src, append(args, m.policyArgs()...), m.withConfig(stack))
+}
+
+// Runs the `pulumi preview` command for the given stack and directory returning
+// the output of the diff together with the update plan that was saved by the
+// same preview. Pass the plan to `up`, with the same targets, to apply exactly
+// the changes that were reviewed.
+// NOTE: update plans are an experimental feature of Pulumi.
+func (m *Pulumi) PreviewPlan(ctx context.Context, src *dagger.Directory, stack string,
+	// URNs of the only resources to preview
+	// +optional
+	target []string,
+	// URNs of resources to leave out of the preview
+	// +optional
+	exclude []string,
+	// URNs of resources to replace
+	// +optional
+	replace []string,
+	// Also preview the resources that depend on the targets
+	// +optional
+	targetDependents bool,
+) (*PlannedPreview, error) {
+	targets := targetOptions{target: target, exclude: exclude, replace: replace, targetDependents: targetDependents}
+	if err := m.validateTargets(ctx, src, stack, targets); err != nil {
+		return nil, err
+	}
+
+	ct, err := m.authenticatedContainer(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	args := append([]string{"preview", "--stack", stack, "--non-interactive", "--diff", "--save-plan", PlanPath}, targets.args()...)
+	ct = ct.
+		With(m.withConfig(stack)).
+		WithEnvVariable("PULUMI_EXPERIMENTAL", "true")
+	ct, err = engineExec(ctx, ct, append(args, m.policyArgs()...))
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := ct.Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &PlannedPreview{
+		Output: out,
+		Plan:   ct.File(PlanPath),
+	}, nil
 }
 
 // Runs the `pulumi refresh` command for the given stack and directory
 // returning the output of the diff if there was any
-func (m *Pulumi) Refresh(ctx context.Context, src *dagger.Directory, stack string) (string, error) {
-	return m.commandOutput(ctx, src, fmt.Sprintf("pulumi refresh --stack %s --non-interactive --diff", stack))
+func (m *Pulumi) Refresh(ctx context.Context, src *dagger.Directory, stack string,
+	// URNs of the only resources to refresh
+	// +optional
+	target []string,
+	// URNs of resources to leave out of the refresh
+	// +optional
+	exclude []string,
+	// Also refresh the resources that depend on the targets
+	// +optional
+	targetDependents bool,
+) (string, error) {
+	targets := targetOptions{target: target, exclude: exclude, targetDependents: targetDependents}
+	if err := m.validateTargets(ctx, src, stack, targets); err != nil {
+		return "", err
+	}
+
+	args := append([]string{"refresh", "--stack", stack, "--non-interactive", "--diff"}, targets.args()...)
+	return m.execOutput(ctx, src, args, m.withConfig(stack), withCacheBust)
 }
 
 // Destroy runs the `pulumi destroy` command for the given stack and directory.
 // NOTE: This command will destroy all the resources created by the stack.
-func (m *Pulumi) Destroy(ctx context.Context, src *dagger.Directory, stack string) (string, error) {
-	return m.commandOutput(ctx, src, fmt.Sprintf("pulumi destroy --stack %s --non-interactive --yes", stack))
+func (m *Pulumi) Destroy(ctx context.Context, src *dagger.Directory, stack string,
+	// URNs of the only resources to destroy
+	// +optional
+	target []string,
+	// URNs of resources to leave out of the destroy
+	// +optional
+	exclude []string,
+	// Also destroy the resources that depend on the targets
+	// +optional
+	targetDependents bool,
+) (string, error) {
+	targets := targetOptions{target: target, exclude: exclude, targetDependents: targetDependents}
+	if err := m.validateTargets(ctx, src, stack, targets); err != nil {
+		return "", err
+	}
+
+	args := append([]string{"destroy", "--stack", stack, "--non-interactive", "--yes"}, targets.args()...)
+	return m.execOutput(ctx, src, args, m.withConfig(stack), withCacheBust)
 }
 
-// Runs the specified pulumi command. For example: preview --diff.
-func (m *Pulumi) Run(ctx context.Context, src *dagger.Directory, command string) (string, error) {
-	return m.commandOutput(ctx, src, fmt.Sprintf("pulumi %s", command))
+// Runs the pulumi command with the specified arguments, for example: ["preview", "--diff"].
+// The arguments are passed as is so they don't need any shell quoting.
+func (m *Pulumi) Run(ctx context.Context, src *dagger.Directory, args []string) (string, error) {
+	return m.execOutput(ctx, src, args)
 }
 
 // Gets the output value from the stack.
 func (m *Pulumi) Output(ctx context.Context, src *dagger.Directory, property string, stack string) (string, error) {
-	selectCmd := fmt.Sprintf("pulumi stack select %s", stack)
-	outputCmd := fmt.Sprintf("pulumi stack output %s", property)
-	return m.commandOutput(ctx, src, fmt.Sprintf("%s && %s", selectCmd, outputCmd))
+	return m.execOutput(ctx, src, []string{"stack", "output", property, "--stack", stack, "--non-interactive"}, m.withConfig(stack), withCacheBust)
 }
 
-// commandOutput runs the given command in the pulumi container and returns its output.
-func (m *Pulumi) commandOutput(ctx context.Context, src *dagger.Directory, command string) (string, error) {
+// execOutput runs the pulumi command with the given arguments in the pulumi
+// container and returns its output.
+func (m *Pulumi) execOutput(ctx context.Context, src *dagger.Directory, args []string, opts ...dagger.WithContainerFunc) (string, error) {
 	ct, err := m.authenticatedContainer(ctx, src)
 	if err != nil {
 		return "", err
 	}
 
+	for _, opt := range opts {
+		ct = ct.With(opt)
+	}
+
 	return ct.
-		WithExec([]string{"/bin/bash", "-c", command}).
+		WithExec(append([]string{"pulumi"}, args...)).
 		Stdout(ctx)
 }
 
+// withCacheBust makes the next command run every time instead of reusing a cached
+// result. Commands that read or change the state of a stack need it since the
+// state also changes outside of the pipeline.
+func withCacheBust(c *dagger.Container) *dagger.Container {
+	return c.WithEnvVariable("CACHE_BUST", time.Now().String())
+}
+
 // Pulumi container with the required credentials
-// Users have to set credentials for their cloud provider by using the `With<Provider>Credentials`
-// function or `WithEsc` function for Pulumi AWS OIDC
+// Users can set credentials for their cloud providers by using the `With<Provider>Credentials`
+// functions, `WithSecretEnv` or the `WithEsc` function for Pulumi AWS OIDC. None of them
+// are required since stacks may use providers that need no credentials
 func (m *Pulumi) authenticatedContainer(ctx context.Context, src *dagger.Directory) (*dagger.Container, error) {
-	if m.PulumiToken == nil {
-		return nil, errors.New("pulumi token is required. Use `with-pulumi-token` to set it")
+	if m.PulumiToken == nil && m.BackendUrl == "" {
+		return nil, errors.New("pulumi token or backend is required. Use `with-pulumi-token` or `with-backend` to set it")
+	}
+
+	if err := m.checkBackendCredentials(); err != nil {
+		return nil, err
 	}
 
 	ct, err := m.container(ctx, src, m.PulumiToken, m.Version)
@@ -117,13 +461,21 @@ func (m *Pulumi) authenticatedContainer(ctx context.Context, src *dagger.Directo
 		return nil, err
 	}
 
-	if m.EscEnv == "" {
-		switch {
-		case m.AwsAccessKey != nil && m.AwsSecretKey != nil:
-			ct = ct.WithSecretVariable("AWS_ACCESS_KEY_ID", m.AwsAccessKey).
-				WithSecretVariable("AWS_SECRET_ACCESS_KEY", m.AwsSecretKey)
-		default:
-			return nil, errors.New("no cloud provider credentails was provided")
+	ct, err = m.withBackend(ct)
+	if err != nil {
+		return nil, err
+	}
+
+	ct = ct.With(m.withCredentials)
+
+	if m.EscEnv != "" {
+		if m.PulumiToken == nil {
+			return nil, errors.New("pulumi token is required to use ESC. Use `with-pulumi-token` to set it")
+		}
+
+		ct, err = m.withEsc(ctx, ct)
+		if err != nil {
+			return nil, err
 		}
 	}
 	return ct, nil
@@ -131,20 +483,31 @@ func (m *Pulumi) authenticatedContainer(ctx context.Context, src *dagger.Directo
 
 // Base container with Pulumi's CLI installed.
 func (m *Pulumi) container(ctx context.Context, src *dagger.Directory, pulumiToken *dagger.Secret, version string) (*dagger.Container, error) {
-	f := src.File("Pulumi.yaml")
-	if f == nil {
-		return nil, errors.New("a Pulumi.yaml file not found")
+	policyPacks, err := m.readPolicyPacks(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	b, err := f.Contents(ctx)
+	ct, err := m.runtimeContainer(ctx, src, pulumiToken, version, policyPacks)
 	if err != nil {
 		return nil, err
 	}
 
-	project := struct {
-		Runtime string `yaml:"runtime"`
-	}{}
-	if err := yaml.Unmarshal([]byte(b), &project); err != nil {
+	ct, err = m.withPolicyPacks(ctx, ct, policyPacks)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.withDocker(ct), nil
+}
+
+// runtimeContainer returns a container with Pulumi's CLI and the runtime of the
+// project with its dependencies installed. The image has every runtime when
+// a policy pack uses a runtime other than the one of the project.
+func (m *Pulumi) runtimeContainer(ctx context.Context, src *dagger.Directory, pulumiToken *dagger.Secret, version string, policyPacks []*project) (*dagger.Container, error) {
+	projectDir := m.projectDir(src)
+	project, err := readProject(ctx, projectDir)
+	if err != nil {
 		return nil, err
 	}
 
@@ -152,34 +515,139 @@ func (m *Pulumi) container(ctx context.Context, src *dagger.Directory, pulumiTok
 		version = "latest"
 	}
 
-	depCmd := ""
-	switch project.Runtime {
-	case "go":
-		depCmd = "go mod tidy"
-	case "nodejs":
-		depCmd = "npm install"
-	case "python":
-		depCmd = "pip install -r requirements.txt"
-	case "dotnet":
-	default:
-		return nil, fmt.Errorf("unsupported pulumi runtime: %s", project.Runtime)
+	image, err := project.Runtime.image(version)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pack := range policyPacks {
+		if pack.Runtime.Name != project.Runtime.Name {
+			// Policy packs run with the language host of their runtime so
+			// the image with every runtime is needed
+			image = fmt.Sprintf("pulumi/pulumi:%s", version)
+		}
+	}
+
+	depCmd, err := project.Runtime.installCommand(ctx, projectDir)
+	if err != nil {
+		return nil, err
 	}
 
-	escInstallCmd := "curl -fsSL https://get.pulumi.com/esc/install.sh | sh"
-	escOpenCmd := fmt.Sprintf("$HOME/.pulumi/bin/esc env open %s", m.EscEnv)
 	ct := dag.
 		Container().
-		From(fmt.Sprintf("pulumi/pulumi-%s:%s", project.Runtime, version)).
-		WithSecretVariable("PULUMI_ACCESS_TOKEN", pulumiToken).
+		From(image).
+		With(func(c *dagger.Container) *dagger.Container {
+			if pulumiToken != nil {
+				c = c.WithSecretVariable("PULUMI_ACCESS_TOKEN", pulumiToken)
+			}
+			return c
+		}).
+		With(project.withCaches).
 		WithMountedDirectory("/infra", src).
-		WithWorkdir("/infra").
-		WithExec([]string{"/bin/bash", "-c", depCmd}).
-		WithExec([]string{"/bin/bash", "-c", escInstallCmd}).
-		WithExec([]string{"/bin/bash", "-c", escOpenCmd})
-	if m.Docker {
-		ct = ct.
-			WithEnvVariable("DOCKER_HOST", "tcp://docker:2375").
-			WithServiceBinding("docker", dag.Docker().Engine())
+		WithWorkdir(path.Join("/infra", m.ProjectPath)).
+		With(func(c *dagger.Container) *dagger.Container {
+			if len(depCmd) > 0 {
+				c = c.WithExec(depCmd)
+			}
+			for _, plugin := range m.Plugins {
+				args := []string{"pulumi", "plugin", "install", plugin.Kind, plugin.Name, plugin.Version}
+				if plugin.Server != "" {
+					args = append(args, "--server", plugin.Server)
+				}
+				c = c.WithExec(args)
+			}
+			return c
+		})
+	return ct, nil
+}
+
+// projectDir returns the directory of the project in the source directory.
+func (m *Pulumi) projectDir(src *dagger.Directory) *dagger.Directory {
+	if m.ProjectPath == "" {
+		return src
+	}
+	return src.Directory(m.ProjectPath)
+}
+
+// withBackend configures the container to use the self-managed backend, if any,
+// mounting its state and setting its credentials.
+func (m *Pulumi) withBackend(ct *dagger.Container) (*dagger.Container, error) {
+	if m.Passphrase != nil {
+		ct = ct.WithSecretVariable("PULUMI_CONFIG_PASSPHRASE", m.Passphrase)
+	}
+
+	if m.BackendUrl == "" {
+		return ct, nil
+	}
+
+	u, err := neturl.Parse(m.BackendUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	ct = ct.WithEnvVariable("PULUMI_BACKEND_URL", m.BackendUrl)
+	if m.BackendService != nil {
+		ct = ct.WithServiceBinding(backendHost(u), m.BackendService)
+	}
+
+	switch u.Scheme {
+	case "file":
+		ct = ct.WithMountedCache(u.Path, m.BackendState)
+	case "s3":
+		if m.BackendAccessKey != nil && m.BackendSecretKey != nil {
+			ct = ct.WithSecretVariable("AWS_ACCESS_KEY_ID", m.BackendAccessKey).
+				WithSecretVariable("AWS_SECRET_ACCESS_KEY", m.BackendSecretKey)
+		}
+	case "azblob":
+		if m.BackendAccessKey != nil && m.BackendSecretKey != nil {
+			ct = ct.WithSecretVariable("AZURE_STORAGE_ACCOUNT", m.BackendAccessKey).
+				WithSecretVariable("AZURE_STORAGE_KEY", m.BackendSecretKey)
+		}
+	case "gs":
+		if m.BackendCredentials != nil {
+			ct = ct.WithMountedSecret("/root/.config/gcloud/backend-credentials.json", m.BackendCredentials).
+				WithEnvVariable("GOOGLE_APPLICATION_CREDENTIALS", "/root/.config/gcloud/backend-credentials.json")
+		}
 	}
 	return ct, nil
 }
+
+// checkBackendCredentials returns an error if the credentials of the backend
+// and of a provider would be set on the same environment variables, since the
+// ones of the provider would replace the ones of the backend.
+func (m *Pulumi) checkBackendCredentials() error {
+	if m.BackendUrl == "" {
+		return nil
+	}
+
+	u, err := neturl.Parse(m.BackendUrl)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case u.Scheme == "s3" && m.BackendAccessKey != nil && (m.AwsAccessKey != nil || m.AwsCredentialsFile != nil):
+		return errors.New("the credentials of an s3:// backend can't be set together with AWS credentials since both use the AWS environment variables")
+	case u.Scheme == "gs" && m.BackendCredentials != nil && m.GcpCredentials != nil:
+		return errors.New("the credentials of a gs:// backend can't be set together with GCP credentials since both use GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	return nil
+}
+
+// backendHost returns the host of the endpoint set on the backend URL, which is
+// used as the alias of the backend service.
+func backendHost(u *neturl.URL) string {
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		return ""
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+
+	e, err := neturl.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	return e.Hostname()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"main/internal/dagger"
+	"maps"
+	"slices"
+	"strings"
+)
+
+const (
+	// maxMarkdownValue is the length at which the values of the property diffs are cut
+	maxMarkdownValue = 300
+	// markdownNoteSize is the space reserved for the truncation note of the report
+	markdownNoteSize = 200
+)
+
+// markdownOperations is the order in which the operations are listed in the summary
+var markdownOperations = []string{"create", "update", "replace", "delete", "same"}
+
+// Runs the `pulumi preview` command for the given stack and directory returning
+// a Markdown report of the changes that is meant to be posted as a pull request
+// comment. The report has a summary of the operations, the property diffs of each
+// resource with secrets redacted, the warnings and the policy violations.
+func (m *Pulumi) PreviewMarkdown(ctx context.Context, src *dagger.Directory, stack string,
+	// Maximum size of the report in bytes. Resources and messages that don't fit are
+	// left out with a note. The default fits the size limit of GitHub comments
+	// +optional
+	// +default=65000
+	maxSize int,
+) (string, error) {
+	digest, err := m.previewDigest(ctx, src, stack)
+	if err != nil {
+		return "", err
+	}
+	return digest.markdown(stack, maxSize)
+}
+
+// markdown renders the digest as a collapsible Markdown report no bigger than maxSize.
+func (d *previewDigest) markdown(stack string, maxSize int) (string, error) {
+	head := d.markdownSummary(stack)
+	tail := "</details>\n"
+
+	budget := maxSize - len(head) - len(tail) - markdownNoteSize
+	if budget < 0 {
+		return "", fmt.Errorf("max size %d is too small for the preview report", maxSize)
+	}
+
+	changes := &markdownSection{title: "Changes"}
+	warnings := &markdownSection{title: "Warnings"}
+	violations := &markdownSection{title: "Policy violations"}
+
+	// Warnings and violations are added first since they are short and are
+	// the most important part of the report
+	for _, diag := range d.Diagnostics {
+		if diag.Severity == "warning" {
+			budget = warnings.add(budget, markdownMessage(diag.Urn, diag.Message))
+		}
+	}
+	for _, v := range d.violations {
+		budget = violations.add(budget, markdownMessage(v.Urn, fmt.Sprintf("**%s** %s/%s: %s", v.EnforcementLevel, v.PolicyPack, v.Policy, v.Message)))
+	}
+	for _, step := range d.Steps {
+		if step.Op != "same" {
+			budget = changes.add(budget, step.markdown())
+		}
+	}
+
+	b := &strings.Builder{}
+	b.WriteString(head)
+	for _, section := range []*markdownSection{changes, warnings, violations} {
+		b.WriteString(section.String())
+	}
+
+	if omitted := changes.omitted + warnings.omitted + violations.omitted; omitted > 0 {
+		fmt.Fprintf(b, "> [!NOTE]\n> The report was truncated to %d bytes. Not shown: resource changes %d, warnings %d, policy violations %d.\n\n",
+			maxSize, changes.omitted, warnings.omitted, violations.omitted)
+	}
+
+	b.WriteString(tail)
+	return b.String(), nil
+}
+
+// markdownSummary returns the header of the report with the table of operations.
+func (d *previewDigest) markdownSummary(stack string) string {
+	b := &strings.Builder{}
+
+	// Operations other than the common ones, such as import, are listed last
+	ops := slices.Clone(markdownOperations)
+	for _, op := range slices.Sorted(maps.Keys(d.ChangeSummary)) {
+		if !slices.Contains(ops, op) {
+			ops = append(ops, op)
+		}
+	}
+
+	counts := []string{}
+	for _, op := range ops {
+		if op != "same" && d.ChangeSummary[op] > 0 {
+			counts = append(counts, fmt.Sprintf("%d to %s", d.ChangeSummary[op], op))
+		}
+	}
+	summary := "no changes"
+	if len(counts) > 0 {
+		summary = strings.Join(counts, ", ")
+	}
+	fmt.Fprintf(b, "<details>\n<summary><b>Pulumi preview of <code>%s</code></b>: %s</summary>\n\n", html.EscapeString(stack), summary)
+
+	b.WriteString("| Operation | Resources |\n| --- | ---: |\n")
+	for _, op := range ops {
+		if d.ChangeSummary[op] > 0 {
+			fmt.Fprintf(b, "| %s | %d |\n", op, d.ChangeSummary[op])
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// markdown renders the step as a collapsible block with its property diffs.
+func (s previewStep) markdown() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "<details>\n<summary><b>%s</b> <code>%s</code> %s</summary>\n\n",
+		s.Op, html.EscapeString(s.resourceType()), markdownCode(urnName(s.Urn)))
+
+	diffs := s.propertyDiffs()
+	if len(diffs) == 0 {
+		b.WriteString("No property changes are reported.\n\n</details>\n\n")
+		return b.String()
+	}
+
+	b.WriteString("| Property | Change | Before | After |\n| --- | --- | --- | --- |\n")
+	for _, diff := range diffs {
+		fmt.Fprintf(b, "| %s | %s | %s | %s |\n", markdownCode(diff.Path), diff.Kind, markdownCode(diff.Old), markdownCode(diff.New))
+	}
+	b.WriteString("\n</details>\n\n")
+	return b.String()
+}
+
+// markdownSection is a section of the report with the items that fit the budget.
+type markdownSection struct {
+	title   string
+	items   []string
+	omitted int
+}
+
+// add adds the item if it fits the budget and returns the remaining budget.
+// The header and the end of the section are accounted when the first item is added.
+func (s *markdownSection) add(budget int, item string) int {
+	size := len(item)
+	if len(s.items) == 0 {
+		size += len(s.header()) + 1
+	}
+	if size > budget {
+		s.omitted++
+		return budget
+	}
+	s.items = append(s.items, item)
+	return budget - size
+}
+
+func (s *markdownSection) header() string {
+	return fmt.Sprintf("#### %s\n\n", s.title)
+}
+
+func (s *markdownSection) String() string {
+	if len(s.items) == 0 {
+		return ""
+	}
+	return s.header() + strings.Join(s.items, "") + "\n"
+}
+
+// markdownMessage returns a list item with the message and the resource it refers to.
+func markdownMessage(urn, msg string) string {
+	msg = strings.ReplaceAll(strings.TrimSpace(msg), "\n", "\n  ")
+	if urn == "" {
+		return fmt.Sprintf("- %s\n", msg)
+	}
+	return fmt.Sprintf("- %s: %s\n", markdownCode(urnName(urn)), msg)
+}
+
+// markdownCode returns the value as inline code that can be used in tables. Long
+// values are cut.
+func markdownCode(v string) string {
+	if v == "" {
+		return ""
+	}
+	if len(v) > maxMarkdownValue {
+		v = strings.ToValidUTF8(v[:maxMarkdownValue], "") + "…"
+	}
+	v = strings.ReplaceAll(html.EscapeString(v), "|", "&#124;")
+	v = strings.ReplaceAll(v, "\n", " ")
+	return "<code>" + v + "</code>"
+}
+
+// urnName returns the name of the resource from its URN.
+func urnName(urn string) string {
+	if i := strings.LastIndex(urn, "::"); i >= 0 {
+		return urn[i+2:]
+	}
+	return urn
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"main/internal/dagger"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// StackOutput is an output of a stack
+type StackOutput struct {
+	// Name of the output
+	Name string
+	// JSON encoded value of the output. Secret outputs have the value "[secret]",
+	// use `secret-output` to get their actual value
+	Value string
+	// Whether the output is a secret
+	Secret bool
+}
+
+// Gets every output of the stack. The value of secret outputs is not shown.
+func (m *Pulumi) Outputs(ctx context.Context, src *dagger.Directory, stack string) ([]*StackOutput, error) {
+	out, err := m.execOutput(ctx, src, []string{"stack", "output", "--json", "--stack", stack, "--non-interactive"}, m.withConfig(stack), withCacheBust)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(out), &values); err != nil {
+		return nil, err
+	}
+
+	outputs := []*StackOutput{}
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		value := string(values[name])
+		outputs = append(outputs, &StackOutput{
+			Name:   name,
+			Value:  value,
+			Secret: value == `"[secret]"`,
+		})
+	}
+	return outputs, nil
+}
+
+// Gets the value of an output of the stack as a secret, which can be passed to
+// other containers without being exposed, for example a database password.
+// String outputs are returned as is while other outputs are JSON encoded.
+func (m *Pulumi) SecretOutput(ctx context.Context, src *dagger.Directory, stack string, name string) (*dagger.Secret, error) {
+	ct, err := m.authenticatedContainer(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	// The output is written to a file instead of stdout so that its value
+	// doesn't show up in the logs
+	value, err := ct.
+		With(m.withConfig(stack)).
+		With(withCacheBust).
+		WithExec([]string{"pulumi", "stack", "output", name, "--show-secrets", "--stack", stack, "--non-interactive"}, dagger.ContainerWithExecOpts{
+			RedirectStdout: "/tmp/output",
+		}).
+		File("/tmp/output").
+		Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	value = strings.TrimSuffix(value, "\n")
+	return dag.SetSecret(fmt.Sprintf("pulumi-output-%s-%d", name, time.Now().UnixNano()), value), nil
+}
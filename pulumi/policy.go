@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"main/internal/dagger"
+	"strings"
+)
+
+// eventLogPath is where the engine events of preview and up are logged so that
+// the policy violations can be reported
+const eventLogPath = "/tmp/pulumi-events.jsonl"
+
+// PolicyPack is a CrossGuard policy pack that is enforced on preview and up
+type PolicyPack struct {
+	// Directory of the policy pack with its PulumiPolicy.yaml file
+	Dir *dagger.Directory
+	// Configuration of the policies of the pack
+	Config *dagger.File
+}
+
+// PolicyViolation is a violation of a policy reported by a policy pack
+type PolicyViolation struct {
+	// Name of the policy pack
+	PolicyPack string
+	// Name of the policy
+	Policy string
+	// URN of the resource that violates the policy, empty for stack policies
+	Urn string
+	// Message of the violation
+	Message string
+	// Enforcement level of the policy: advisory, mandatory or remediate
+	EnforcementLevel string
+}
+
+// Enforces a CrossGuard policy pack on preview and up. The dependencies of the
+// pack are installed with the toolchain of its runtime. Mandatory violations
+// make the command fail.
+func (m *Pulumi) WithPolicyPack(
+	// Directory of the policy pack with its PulumiPolicy.yaml file
+	dir *dagger.Directory,
+	// JSON configuration of the policies of the pack
+	// +optional
+	config *dagger.File,
+) *Pulumi {
+	m.PolicyPacks = append(m.PolicyPacks, &PolicyPack{
+		Dir:    dir,
+		Config: config,
+	})
+	return m
+}
+
+// policyPackPath returns where the i-th policy pack is mounted.
+func policyPackPath(i int) string {
+	return fmt.Sprintf("/policy-packs/%d", i)
+}
+
+// readPolicyPacks reads and parses the PulumiPolicy.yaml files of the policy packs.
+func (m *Pulumi) readPolicyPacks(ctx context.Context) ([]*project, error) {
+	packs := []*project{}
+	for _, pack := range m.PolicyPacks {
+		p, err := readProjectFile(ctx, pack.Dir, "PulumiPolicy.yaml")
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, p)
+	}
+	return packs, nil
+}
+
+// withPolicyPacks mounts the policy packs with their dependencies installed.
+// Packs without a configuration get an empty one since Pulumi requires either
+// none or one for each pack.
+func (m *Pulumi) withPolicyPacks(ctx context.Context, ct *dagger.Container, packs []*project) (*dagger.Container, error) {
+	for i, pack := range m.PolicyPacks {
+		path := policyPackPath(i)
+
+		cmd, err := packs[i].Runtime.installCommand(ctx, pack.Dir)
+		if err != nil {
+			return nil, err
+		}
+
+		dir := pack.Dir
+		if len(cmd) > 0 {
+			dir = ct.
+				With(packs[i].withCaches).
+				WithMountedDirectory(path, pack.Dir).
+				WithWorkdir(path).
+				WithExec(cmd).
+				Directory(path)
+		}
+		ct = ct.WithMountedDirectory(path, dir)
+
+		if pack.Config != nil {
+			ct = ct.WithMountedFile(path+".json", pack.Config)
+		} else {
+			ct = ct.WithNewFile(path+".json", "{}")
+		}
+	}
+	return ct, nil
+}
+
+// policyArgs returns the flags that enforce the policy packs.
+func (m *Pulumi) policyArgs() []string {
+	args := []string{}
+	for i := range m.PolicyPacks {
+		path := policyPackPath(i)
+		args = append(args, "--policy-pack", path, "--policy-pack-config", path+".json")
+	}
+	return args
+}
+
+// engineExec runs a pulumi command that runs the engine, such as preview or up,
+// logging its events. When the command fails because of mandatory policy
+// violations the error summarizes them. The command never reuses a cached result:
+// its failures are successful execs to the engine, which would be replayed on retries.
+func engineExec(ctx context.Context, ct *dagger.Container, args []string) (*dagger.Container, error) {
+	ct = ct.With(withCacheBust).WithExec(append(append([]string{"pulumi"}, args...), "--event-log", eventLogPath), dagger.ContainerWithExecOpts{
+		Expect: dagger.ReturnTypeAny,
+	})
+
+	exitCode, err := ct.ExitCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode == 0 {
+		return ct, nil
+	}
+
+	if err := policyError(args[0], policyViolations(ctx, ct)); err != nil {
+		return nil, err
+	}
+	stdout, _ := ct.Stdout(ctx)
+	stderr, _ := ct.Stderr(ctx)
+	return nil, fmt.Errorf("pulumi %s failed with exit code %d:\n%s%s", args[0], exitCode, stdout, stderr)
+}
+
+// engineOutput runs a pulumi command that runs the engine with engineExec and
+// returns its output.
+func (m *Pulumi) engineOutput(ctx context.Context, src *dagger.Directory, args []string, opts ...dagger.WithContainerFunc) (string, error) {
+	ct, err := m.authenticatedContainer(ctx, src)
+	if err != nil {
+		return "", err
+	}
+
+	for _, opt := range opts {
+		ct = ct.With(opt)
+	}
+
+	ct, err = engineExec(ctx, ct, args)
+	if err != nil {
+		return "", err
+	}
+	return ct.Stdout(ctx)
+}
+
+// engineEvent is an event of the event log. Only policy events are decoded.
+type engineEvent struct {
+	PolicyEvent *policyEvent `json:"policyEvent"`
+}
+
+type policyEvent struct {
+	ResourceUrn      string `json:"resourceUrn"`
+	Message          string `json:"message"`
+	PolicyName       string `json:"policyName"`
+	PolicyPackName   string `json:"policyPackName"`
+	EnforcementLevel string `json:"enforcementLevel"`
+}
+
+// policyViolations returns the policy violations logged by the command that
+// the container ran.
+func policyViolations(ctx context.Context, ct *dagger.Container) []*PolicyViolation {
+	violations := []*PolicyViolation{}
+
+	// The log doesn't exist if the command failed before the engine started
+	log, err := ct.File(eventLogPath).Contents(ctx)
+	if err != nil {
+		return violations
+	}
+
+	dec := json.NewDecoder(strings.NewReader(log))
+	for {
+		event := &engineEvent{}
+		// The last event may be truncated if the command was interrupted
+		if err := dec.Decode(event); err != nil {
+			return violations
+		}
+		if event.PolicyEvent == nil {
+			continue
+		}
+
+		violations = append(violations, &PolicyViolation{
+			PolicyPack:       event.PolicyEvent.PolicyPackName,
+			Policy:           event.PolicyEvent.PolicyName,
+			Urn:              event.PolicyEvent.ResourceUrn,
+			Message:          strings.TrimSpace(event.PolicyEvent.Message),
+			EnforcementLevel: event.PolicyEvent.EnforcementLevel,
+		})
+	}
+}
+
+// policyError returns an error that summarizes the mandatory violations, or nil
+// if there are none.
+func policyError(command string, violations []*PolicyViolation) error {
+	summary := []string{}
+	for _, v := range violations {
+		if v.EnforcementLevel != "mandatory" {
+			continue
+		}
+		line := fmt.Sprintf("- %s/%s", v.PolicyPack, v.Policy)
+		if v.Urn != "" {
+			line += " on " + v.Urn
+		}
+		summary = append(summary, line+":\n  "+strings.ReplaceAll(v.Message, "\n", "\n  "))
+	}
+	if len(summary) == 0 {
+		return nil
+	}
+	return fmt.Errorf("pulumi %s failed with %d mandatory policy violations:\n%s", command, len(summary), strings.Join(summary, "\n"))
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"main/internal/dagger"
+	"strings"
+)
+
+// PreviewResult is the result of a `pulumi preview` parsed from its JSON output
+type PreviewResult struct {
+	// Number of resources that would be created
+	Creates int
+	// Number of resources that would be updated
+	Updates int
+	// Number of resources that would be replaced
+	Replaces int
+	// Number of resources that would be deleted
+	Deletes int
+	// Number of resources that would not change
+	Sames int
+	// Resources that would change
+	Resources []*ResourceChange
+	// Diagnostics reported by the program and the providers
+	Diagnostics []*Diagnostic
+	// Violations reported by the policy packs
+	PolicyViolations []*PolicyViolation
+}
+
+// ResourceChange is an operation that would be performed on a resource
+type ResourceChange struct {
+	// URN of the resource
+	Urn string
+	// Type of the resource, for example: aws:s3/bucket:Bucket
+	Type string
+	// Operation that would be performed, for example: create, update, replace or delete
+	Operation string
+}
+
+// Diagnostic is a message reported during a Pulumi operation
+type Diagnostic struct {
+	// URN of the resource that reported the message, if any
+	Urn string
+	// Severity of the message, for example: info, warning or error
+	Severity string
+	// The message
+	Message string
+}
+
+// Whether the preview would replace any resource
+func (r *PreviewResult) HasReplacements() bool {
+	return r.Replaces > 0
+}
+
+// Whether the preview would delete any resource
+func (r *PreviewResult) HasDeletes() bool {
+	return r.Deletes > 0
+}
+
+// Whether the preview would perform any change
+func (r *PreviewResult) HasChanges() bool {
+	return r.Creates+r.Updates+r.Replaces+r.Deletes > 0
+}
+
+// Runs the `pulumi preview` command for the given stack and directory returning
+// the changes that would be performed. Use it to gate pipelines on the changes,
+// for example requiring a manual approval if anything would be deleted.
+func (m *Pulumi) PreviewChanges(ctx context.Context, src *dagger.Directory, stack string) (*PreviewResult, error) {
+	digest, err := m.previewDigest(ctx, src, stack)
+	if err != nil {
+		return nil, err
+	}
+	return digest.result(), nil
+}
+
+// previewDigest runs `pulumi preview --json` and decodes its output.
+func (m *Pulumi) previewDigest(ctx context.Context, src *dagger.Directory, stack string) (*previewDigest, error) {
+	return m.digest(ctx, src, stack, "preview")
+}
+
+// digest runs the pulumi command with the --json flag and decodes its output.
+// Commands such as preview and refresh --preview-only share the same output.
+func (m *Pulumi) digest(ctx context.Context, src *dagger.Directory, stack string, args ...string) (*previewDigest, error) {
+	ct, err := m.authenticatedContainer(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	args = append(args, "--stack", stack, "--non-interactive", "--json", "--event-log", eventLogPath)
+	if args[0] == "preview" {
+		// Policy packs are only enforced by preview and up
+		args = append(args, m.policyArgs()...)
+	}
+
+	// The JSON output is printed even if the command fails so that its
+	// diagnostics can be reported. The result is never cached since it depends
+	// on the state of the stack and of the cloud, not only on the program.
+	ct = ct.
+		With(m.withConfig(stack)).
+		With(withCacheBust).
+		WithExec(append([]string{"pulumi"}, args...), dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		})
+
+	stdout, err := ct.Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	exitCode, err := ct.ExitCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := &previewDigest{}
+	if err := json.Unmarshal([]byte(stdout), digest); err != nil {
+		stderr, _ := ct.Stderr(ctx)
+		return nil, fmt.Errorf("failed to parse pulumi %s output: %w\n%s", args[0], err, stderr)
+	}
+	digest.violations = policyViolations(ctx, ct)
+
+	if exitCode != 0 {
+		return nil, digest.err(args[0])
+	}
+	return digest, nil
+}
+
+// previewDigest is the JSON output of `pulumi preview --json`.
+type previewDigest struct {
+	Steps         []previewStep       `json:"steps"`
+	Diagnostics   []previewDiagnostic `json:"diagnostics"`
+	ChangeSummary map[string]int      `json:"changeSummary"`
+
+	// violations are read from the event log since they are not part of the output
+	violations []*PolicyViolation
+}
+
+type previewStep struct {
+	Op           string                  `json:"op"`
+	Urn          string                  `json:"urn"`
+	OldState     *resourceState          `json:"oldState"`
+	NewState     *resourceState          `json:"newState"`
+	DiffReasons  []string                `json:"diffReasons"`
+	DetailedDiff map[string]propertyDiff `json:"detailedDiff"`
+}
+
+type resourceState struct {
+	Type    string         `json:"type"`
+	Inputs  map[string]any `json:"inputs"`
+	Outputs map[string]any `json:"outputs"`
+}
+
+type propertyDiff struct {
+	Kind      diffKind `json:"kind"`
+	InputDiff bool     `json:"inputDiff"`
+}
+
+// diffKind is the kind of change of a property. Depending on the version of
+// Pulumi it is encoded either as its name or as its number.
+type diffKind string
+
+func (k *diffKind) UnmarshalJSON(b []byte) error {
+	var n int
+	if err := json.Unmarshal(b, &n); err == nil {
+		kinds := []diffKind{"add", "add-replace", "delete", "delete-replace", "update", "update-replace"}
+		if n < 0 || n >= len(kinds) {
+			return fmt.Errorf("unknown diff kind: %d", n)
+		}
+		*k = kinds[n]
+		return nil
+	}
+	return json.Unmarshal(b, (*string)(k))
+}
+
+type previewDiagnostic struct {
+	Urn      string `json:"urn"`
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+}
+
+// result converts the digest into a PreviewResult.
+func (d *previewDigest) result() *PreviewResult {
+	res := &PreviewResult{
+		Creates:          d.ChangeSummary["create"],
+		Updates:          d.ChangeSummary["update"],
+		Replaces:         d.ChangeSummary["replace"],
+		Deletes:          d.ChangeSummary["delete"],
+		Sames:            d.ChangeSummary["same"],
+		Resources:        []*ResourceChange{},
+		Diagnostics:      []*Diagnostic{},
+		PolicyViolations: d.violations,
+	}
+
+	for _, step := range d.Steps {
+		if step.Op == "same" {
+			continue
+		}
+		res.Resources = append(res.Resources, &ResourceChange{
+			Urn:       step.Urn,
+			Type:      step.resourceType(),
+			Operation: step.Op,
+		})
+	}
+
+	for _, diag := range d.Diagnostics {
+		res.Diagnostics = append(res.Diagnostics, &Diagnostic{
+			Urn:      diag.Urn,
+			Severity: diag.Severity,
+			Message:  strings.TrimSpace(diag.Message),
+		})
+	}
+	return res
+}
+
+// err returns an error with the messages of the error diagnostics of a failed command.
+func (d *previewDigest) err(command string) error {
+	if err := policyError(command, d.violations); err != nil {
+		return err
+	}
+
+	msgs := []string{}
+	for _, diag := range d.Diagnostics {
+		if diag.Severity == "error" {
+			msgs = append(msgs, strings.TrimSpace(diag.Message))
+		}
+	}
+	if len(msgs) == 0 {
+		return fmt.Errorf("pulumi %s failed", command)
+	}
+	return fmt.Errorf("pulumi %s failed:\n%s", command, strings.Join(msgs, "\n"))
+}
+
+// resourceType returns the type of the resource of the step.
+func (s previewStep) resourceType() string {
+	switch {
+	case s.NewState != nil && s.NewState.Type != "":
+		return s.NewState.Type
+	case s.OldState != nil && s.OldState.Type != "":
+		return s.OldState.Type
+	}
+	return urnType(s.Urn)
+}
+
+// urnType returns the type of the resource from its URN, which has the
+// format urn:pulumi:<stack>::<project>::<parent-type>$<type>::<name>.
+func urnType(urn string) string {
+	parts := strings.Split(urn, "::")
+	if len(parts) < 4 {
+		return ""
+	}
+	t := parts[2]
+	if i := strings.LastIndex(t, "$"); i >= 0 {
+		t = t[i+1:]
+	}
+	return t
+}
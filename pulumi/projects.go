@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"main/internal/dagger"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ProjectPreview is the preview of a project of the source directory
+type ProjectPreview struct {
+	// Path of the project relative to the source directory
+	Path string
+	// Changes that would be performed, empty if the preview failed
+	Result *PreviewResult
+	// Error of the preview if it failed
+	Error string
+}
+
+// Returns the paths of the Pulumi projects of the source directory, for example
+// infra/network and infra/cluster in a monorepo. The root project is returned
+// as ".". Dependency and hidden directories such as node_modules are skipped.
+func (m *Pulumi) Projects(ctx context.Context, src *dagger.Directory) ([]string, error) {
+	files, err := src.Glob(ctx, "**/Pulumi.yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	projects := []string{}
+	for _, file := range files {
+		dir := path.Dir(file)
+		if skipProjectDir(dir) || slices.Contains(projects, dir) {
+			continue
+		}
+		projects = append(projects, dir)
+	}
+
+	slices.Sort(projects)
+	return projects, nil
+}
+
+// skipProjectDir returns whether the directory is a dependency or hidden
+// directory, or is inside of one.
+func skipProjectDir(dir string) bool {
+	for _, name := range strings.Split(dir, "/") {
+		if name == "node_modules" || (strings.HasPrefix(name, ".") && name != ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs the `pulumi preview` command for the given stack of each project of the
+// source directory in parallel, returning the changes per project. A failed
+// preview doesn't stop the others, its error is returned with its project.
+func (m *Pulumi) PreviewProjects(ctx context.Context, src *dagger.Directory, stack string,
+	// Paths of the projects to preview. Defaults to every project of the source directory
+	// +optional
+	projects []string,
+	// Maximum number of previews that run at the same time
+	// +optional
+	// +default=4
+	parallelism int,
+) ([]*ProjectPreview, error) {
+	if len(projects) == 0 {
+		var err error
+		projects, err = m.Projects(ctx, src)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	previews := make([]*ProjectPreview, len(projects))
+	sem := make(chan struct{}, parallelism)
+	wg := sync.WaitGroup{}
+	for i, projectPath := range projects {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			previews[i] = m.previewProject(ctx, src, stack, projectPath)
+		}()
+	}
+	wg.Wait()
+
+	return previews, nil
+}
+
+// previewProject runs the preview of the stack of the project at the path.
+func (m *Pulumi) previewProject(ctx context.Context, src *dagger.Directory, stack string, projectPath string) *ProjectPreview {
+	preview := &ProjectPreview{Path: projectPath}
+
+	// Each project gets its own copy of the module so that they don't share
+	// the project path
+	p := *m
+	if _, err := p.WithProjectPath(projectPath); err != nil {
+		preview.Error = err.Error()
+		return preview
+	}
+
+	res, err := p.PreviewChanges(ctx, src, stack)
+	if err != nil {
+		preview.Error = err.Error()
+		return preview
+	}
+	preview.Result = res
+	return preview
+}
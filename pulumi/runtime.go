@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"main/internal/dagger"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// project is the subset of the Pulumi.yaml file that is needed to build the
+// Pulumi container
+type project struct {
+	Name    string         `yaml:"name"`
+	Runtime projectRuntime `yaml:"runtime"`
+}
+
+// projectRuntime is the runtime of a Pulumi project. In Pulumi.yaml it can be
+// either the name of the runtime or an object with its name and options, for
+// example: {name: python, options: {toolchain: poetry}}
+type projectRuntime struct {
+	Name    string `yaml:"name"`
+	Options struct {
+		// Toolchain of python projects: pip, poetry or uv
+		Toolchain string `yaml:"toolchain"`
+		// Virtualenv of python projects that use pip
+		Virtualenv string `yaml:"virtualenv"`
+		// Package manager of nodejs projects: npm, yarn or pnpm
+		PackageManager string `yaml:"packagemanager"`
+	} `yaml:"options"`
+}
+
+func (r *projectRuntime) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&r.Name)
+	}
+
+	type plain projectRuntime
+	return value.Decode((*plain)(r))
+}
+
+// readProject reads and parses the Pulumi.yaml file of the project.
+func readProject(ctx context.Context, src *dagger.Directory) (*project, error) {
+	return readProjectFile(ctx, src, "Pulumi.yaml")
+}
+
+// readProjectFile reads and parses a project file, such as Pulumi.yaml or the
+// PulumiPolicy.yaml of a policy pack, which share the runtime definition.
+func readProjectFile(ctx context.Context, src *dagger.Directory, name string) (*project, error) {
+	b, err := src.File(name).Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("a %s file not found: %w", name, err)
+	}
+
+	p := &project{}
+	if err := yaml.Unmarshal([]byte(b), p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// image returns the Pulumi image for the runtime.
+func (r *projectRuntime) image(version string) (string, error) {
+	switch r.Name {
+	case "go", "nodejs", "python", "dotnet", "java":
+		return fmt.Sprintf("pulumi/pulumi-%s:%s", r.Name, version), nil
+	case "yaml":
+		// The YAML language host is bundled with the Pulumi CLI
+		return fmt.Sprintf("pulumi/pulumi-base:%s", version), nil
+	default:
+		return "", fmt.Errorf("unsupported pulumi runtime: %s", r.Name)
+	}
+}
+
+// installCommand returns the command that installs the dependencies of the
+// project with the toolchain of the runtime. It is empty when the runtime
+// has no dependencies to install.
+func (r *projectRuntime) installCommand(ctx context.Context, src *dagger.Directory) ([]string, error) {
+	switch r.Name {
+	case "go":
+		return []string{"go", "mod", "tidy"}, nil
+	case "nodejs":
+		packageManager, err := r.packageManager(ctx, src)
+		if err != nil {
+			return nil, err
+		}
+		switch packageManager {
+		case "npm":
+			return []string{"npm", "install"}, nil
+		case "yarn", "pnpm":
+			// yarn and pnpm are installed when the image doesn't ship them
+			return shell(`(command -v "$1" || npm install --global "$1") && "$1" install`, packageManager), nil
+		default:
+			return nil, fmt.Errorf("unsupported nodejs package manager: %s", packageManager)
+		}
+	case "python":
+		switch r.Options.Toolchain {
+		case "", "pip":
+			if r.Options.Virtualenv != "" {
+				return shell(`python -m venv "$1" && "$1/bin/pip" install -r requirements.txt`, r.Options.Virtualenv), nil
+			}
+			return []string{"pip", "install", "-r", "requirements.txt"}, nil
+		case "poetry":
+			return shell(`(command -v poetry || pip install poetry) && poetry install --no-ansi`), nil
+		case "uv":
+			return shell(`(command -v uv || pip install uv) && uv sync`), nil
+		default:
+			return nil, fmt.Errorf("unsupported python toolchain: %s", r.Options.Toolchain)
+		}
+	case "dotnet":
+		return []string{"dotnet", "restore"}, nil
+	case "java", "yaml":
+		// Java dependencies are resolved by maven or gradle when the program is built
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported pulumi runtime: %s", r.Name)
+	}
+}
+
+// testCommand returns the command that runs the unit tests of the program writing
+// a JUnit report to the path.
+func (r *projectRuntime) testCommand(ctx context.Context, src *dagger.Directory, report string) ([]string, error) {
+	switch r.Name {
+	case "go":
+		return []string{"go", "run", "gotest.tools/gotestsum@v1.12.0", "--junitfile", report, "--", "./..."}, nil
+	case "nodejs":
+		packageManager, err := r.packageManager(ctx, src)
+		if err != nil {
+			return nil, err
+		}
+		// The reporter is configured by the test script of the project
+		return []string{packageManager, "test"}, nil
+	case "python":
+		args := []string{"-m", "pytest", "--junitxml", report}
+		switch r.Options.Toolchain {
+		case "", "pip":
+			if r.Options.Virtualenv != "" {
+				return append([]string{r.Options.Virtualenv + "/bin/python"}, args...), nil
+			}
+			return append([]string{"python"}, args...), nil
+		case "poetry":
+			return append([]string{"poetry", "run", "python"}, args...), nil
+		case "uv":
+			return append([]string{"uv", "run", "python"}, args...), nil
+		default:
+			return nil, fmt.Errorf("unsupported python toolchain: %s", r.Options.Toolchain)
+		}
+	default:
+		return nil, fmt.Errorf("unit tests are not supported for the %s runtime", r.Name)
+	}
+}
+
+// sourceExtension returns the extension of the source files of the runtime,
+// which is used to name the code generated by `pulumi import`.
+func (r *projectRuntime) sourceExtension() string {
+	switch r.Name {
+	case "go":
+		return ".go"
+	case "nodejs":
+		// The nodejs code is always generated in TypeScript
+		return ".ts"
+	case "python":
+		return ".py"
+	case "dotnet":
+		return ".cs"
+	case "java":
+		return ".java"
+	default:
+		return ".yaml"
+	}
+}
+
+// shell returns the command that runs the script with bash. Values are passed
+// as positional arguments so that they are never interpolated into the script.
+func shell(script string, args ...string) []string {
+	return append([]string{"/bin/bash", "-c", script, "bash"}, args...)
+}
+
+// packageManager returns the package manager of a nodejs project, which is
+// either set on the runtime options or detected from the lock file.
+func (r *projectRuntime) packageManager(ctx context.Context, src *dagger.Directory) (string, error) {
+	if r.Options.PackageManager != "" {
+		return r.Options.PackageManager, nil
+	}
+
+	entries, err := src.Entries(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case slices.Contains(entries, "pnpm-lock.yaml"):
+		return "pnpm", nil
+	case slices.Contains(entries, "yarn.lock"):
+		return "yarn", nil
+	default:
+		return "npm", nil
+	}
+}
+
+// runtimeCache is a directory of the container where a runtime toolchain stores
+// downloaded dependencies.
+type runtimeCache struct {
+	name string
+	path string
+	// env is set to path so that the toolchain uses the cache directory
+	env string
+}
+
+// caches returns the dependency caches of the toolchains of the runtime.
+func (r *projectRuntime) caches() []runtimeCache {
+	switch r.Name {
+	case "go":
+		return []runtimeCache{
+			{name: "go-mod", path: "/root/.cache/go-mod", env: "GOMODCACHE"},
+			{name: "go-build", path: "/root/.cache/go-build", env: "GOCACHE"},
+		}
+	case "nodejs":
+		return []runtimeCache{
+			{name: "npm", path: "/root/.npm"},
+			{name: "yarn", path: "/root/.cache/yarn", env: "YARN_CACHE_FOLDER"},
+			{name: "pnpm", path: "/root/.cache/pnpm", env: "npm_config_store_dir"},
+		}
+	case "python":
+		return []runtimeCache{
+			{name: "pip", path: "/root/.cache/pip"},
+			{name: "poetry", path: "/root/.cache/pypoetry"},
+			{name: "uv", path: "/root/.cache/uv"},
+		}
+	case "dotnet":
+		return []runtimeCache{
+			{name: "nuget", path: "/root/.nuget/packages"},
+		}
+	case "java":
+		return []runtimeCache{
+			{name: "maven", path: "/root/.m2"},
+			{name: "gradle", path: "/root/.gradle"},
+		}
+	default:
+		return nil
+	}
+}
+
+// withCaches mounts the dependency caches of the runtime and the cache of
+// provider plugins. The caches are keyed by runtime and project.
+func (p *project) withCaches(ct *dagger.Container) *dagger.Container {
+	for _, cache := range p.Runtime.caches() {
+		ct = ct.WithMountedCache(cache.path, dag.CacheVolume(fmt.Sprintf("pulumi-%s-%s-%s", p.Runtime.Name, p.Name, cache.name)))
+		if cache.env != "" {
+			ct = ct.WithEnvVariable(cache.env, cache.path)
+		}
+	}
+
+	return ct.WithMountedCache("/root/.pulumi/plugins", dag.CacheVolume(fmt.Sprintf("pulumi-%s-%s-plugins", p.Runtime.Name, p.Name)))
+}
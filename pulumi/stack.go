@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"main/internal/dagger"
+)
+
+// StackSummary is a stack returned by `pulumi stack ls`
+type StackSummary struct {
+	// Name of the stack
+	Name string `json:"name"`
+	// Whether the stack is the currently selected stack
+	Current bool `json:"current"`
+	// Time of the last update of the stack
+	LastUpdate string `json:"lastUpdate"`
+	// Whether an update of the stack is in progress
+	UpdateInProgress bool `json:"updateInProgress"`
+	// Number of resources of the stack
+	ResourceCount int `json:"resourceCount"`
+	// URL of the stack in the backend
+	Url string `json:"url"`
+}
+
+// Creates a new stack, for example a stack for the preview environment of a pull request
+func (m *Pulumi) StackInit(ctx context.Context, src *dagger.Directory, stack string,
+	// Name of an existing stack to copy the configuration from
+	// +optional
+	copyConfigFrom string,
+	// Secrets provider of the stack, for example: passphrase or awskms://alias/my-key
+	// +optional
+	secretsProvider string,
+) (string, error) {
+	args := []string{"stack", "init", stack, "--non-interactive"}
+	if copyConfigFrom != "" {
+		args = append(args, "--copy-config-from", copyConfigFrom)
+	}
+	if secretsProvider != "" {
+		args = append(args, "--secrets-provider", secretsProvider)
+	}
+	return m.execOutput(ctx, src, args, withCacheBust)
+}
+
+// Removes a stack and its configuration
+// NOTE: without force the stack can only be removed if it has no resources
+func (m *Pulumi) StackRemove(ctx context.Context, src *dagger.Directory, stack string,
+	// Remove the stack even if it still has resources. The resources are not
+	// deleted, use `destroy` before removing the stack for that
+	// +optional
+	force bool,
+) (string, error) {
+	args := []string{"stack", "rm", stack, "--yes", "--non-interactive"}
+	if force {
+		args = append(args, "--force")
+	}
+	return m.execOutput(ctx, src, args, withCacheBust)
+}
+
+// Renames a stack
+func (m *Pulumi) StackRename(ctx context.Context, src *dagger.Directory, stack string, newName string) (string, error) {
+	return m.execOutput(ctx, src, []string{"stack", "rename", newName, "--stack", stack, "--non-interactive"}, withCacheBust)
+}
+
+// Sets a tag on a stack
+func (m *Pulumi) StackTagSet(ctx context.Context, src *dagger.Directory, stack string, name string, value string) (string, error) {
+	return m.execOutput(ctx, src, []string{"stack", "tag", "set", name, value, "--stack", stack, "--non-interactive"}, withCacheBust)
+}
+
+// Lists the stacks of the project
+func (m *Pulumi) StackList(ctx context.Context, src *dagger.Directory,
+	// List the stacks of every project instead of only the current one
+	// +optional
+	all bool,
+) ([]*StackSummary, error) {
+	args := []string{"stack", "ls", "--json", "--non-interactive"}
+	if all {
+		args = append(args, "--all")
+	}
+
+	out, err := m.execOutput(ctx, src, args, withCacheBust)
+	if err != nil {
+		return nil, err
+	}
+
+	stacks := []*StackSummary{}
+	if err := json.Unmarshal([]byte(out), &stacks); err != nil {
+		return nil, err
+	}
+	return stacks, nil
+}
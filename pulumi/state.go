@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"main/internal/dagger"
+)
+
+const (
+	// stackStatePath is where the state of the stack is exported and imported
+	stackStatePath = "/tmp/pulumi-stack.json"
+	// importPath is where the resources to import are mounted
+	importPath = "/tmp/pulumi-import.json"
+	// importOutDir is where the code of the imported resources is generated
+	importOutDir = "/tmp/pulumi-import"
+)
+
+// Exports the state of the stack, for example to back it up before a migration.
+// Secret values are encrypted unless showSecrets is set.
+func (m *Pulumi) StackExport(ctx context.Context, src *dagger.Directory, stack string,
+	// Decrypt the secret values of the state
+	// +optional
+	showSecrets bool,
+) (*dagger.File, error) {
+	ct, err := m.authenticatedContainer(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"pulumi", "stack", "export", "--stack", stack, "--non-interactive", "--file", stackStatePath}
+	if showSecrets {
+		args = append(args, "--show-secrets")
+	}
+
+	ct, err = ct.
+		With(withCacheBust).
+		WithExec(args).
+		Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ct.File(stackStatePath), nil
+}
+
+// Imports a state exported with `stack-export` into the stack, replacing its
+// current state.
+// NOTE: This command can make the stack lose track of its resources
+func (m *Pulumi) StackImport(ctx context.Context, src *dagger.Directory, stack string, state *dagger.File) (string, error) {
+	return m.execOutput(ctx, src, []string{"stack", "import", "--stack", stack, "--non-interactive", "--file", stackStatePath}, func(c *dagger.Container) *dagger.Container {
+		return c.WithMountedFile(stackStatePath, state)
+	}, withCacheBust)
+}
+
+// Deletes a resource from the state of the stack without deleting it from the cloud.
+// NOTE: This command can make the stack lose track of its resources
+func (m *Pulumi) StateDelete(ctx context.Context, src *dagger.Directory, stack string,
+	// URN of the resource
+	urn string,
+	// Delete the resource even if it is protected
+	// +optional
+	force bool,
+	// Also delete the resources that depend on the resource
+	// +optional
+	targetDependents bool,
+) (string, error) {
+	args := []string{"state", "delete", urn, "--stack", stack, "--yes", "--non-interactive"}
+	if force {
+		args = append(args, "--force")
+	}
+	if targetDependents {
+		args = append(args, "--target-dependents")
+	}
+	return m.execOutput(ctx, src, args, withCacheBust)
+}
+
+// Removes the protection of a resource of the stack so that it can be deleted
+func (m *Pulumi) StateUnprotect(ctx context.Context, src *dagger.Directory, stack string,
+	// URN of the resource
+	urn string,
+) (string, error) {
+	return m.execOutput(ctx, src, []string{"state", "unprotect", urn, "--stack", stack, "--yes", "--non-interactive"}, withCacheBust)
+}
+
+// Imports existing cloud resources into the stack returning a directory with the
+// code generated for them, which has to be added to the program. Either a single
+// resource is imported with its type, name and ID, or many of them with a file.
+// NOTE: This command will change the state of the stack
+func (m *Pulumi) Import(ctx context.Context, src *dagger.Directory, stack string,
+	// Type of the resource, for example: aws:s3/bucket:Bucket
+	// +optional
+	resourceType string,
+	// Name of the resource in the program
+	// +optional
+	name string,
+	// ID of the resource in the cloud
+	// +optional
+	id string,
+	// JSON file with the resources to import, as documented by `pulumi import --file`
+	// +optional
+	file *dagger.File,
+	// Only generate the code without importing the resources
+	// +optional
+	previewOnly bool,
+) (*dagger.Directory, error) {
+	args := []string{"pulumi", "import", "--stack", stack, "--yes", "--non-interactive"}
+	switch {
+	case file != nil && (resourceType != "" || name != "" || id != ""):
+		return nil, errors.New("either a file or the type, name and id of a resource must be set, not both")
+	case file != nil:
+		args = append(args, "--file", importPath)
+	case resourceType != "" && name != "" && id != "":
+		args = append(args, resourceType, name, id)
+	default:
+		return nil, errors.New("the type, name and id of the resource or a file with the resources are required")
+	}
+	if previewOnly {
+		args = append(args, "--preview-only")
+	}
+
+	project, err := readProject(ctx, m.projectDir(src))
+	if err != nil {
+		return nil, err
+	}
+
+	ct, err := m.authenticatedContainer(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	if file != nil {
+		ct = ct.WithMountedFile(importPath, file)
+	}
+
+	// The providers of the resources are configured with the stack configuration
+	ct, err = ct.
+		With(m.withConfig(stack)).
+		WithDirectory(importOutDir, dag.Directory()).
+		With(withCacheBust).
+		WithExec(append(args, "--out", importOutDir+"/import"+project.Runtime.sourceExtension())).
+		Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ct.Directory(importOutDir), nil
+}
+
+// Cancels the update in progress of the stack, which clears the lock left by an
+// update that was interrupted
+// NOTE: the resources that were being changed by the update may be left in an inconsistent state
+func (m *Pulumi) CancelUpdate(ctx context.Context, src *dagger.Directory, stack string) (string, error) {
+	return m.execOutput(ctx, src, []string{"cancel", "--stack", stack, "--yes", "--non-interactive"}, withCacheBust)
+}
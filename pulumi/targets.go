@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"main/internal/dagger"
+	"strings"
+)
+
+// targetOptions limit an operation to some of the resources of the stack.
+type targetOptions struct {
+	target           []string
+	exclude          []string
+	replace          []string
+	targetDependents bool
+}
+
+// args returns the flags of the options.
+func (t targetOptions) args() []string {
+	args := []string{}
+	for _, urn := range t.target {
+		args = append(args, "--target", urn)
+	}
+	for _, urn := range t.exclude {
+		args = append(args, "--exclude", urn)
+	}
+	for _, urn := range t.replace {
+		args = append(args, "--replace", urn)
+	}
+	if t.targetDependents {
+		args = append(args, "--target-dependents")
+	}
+	return args
+}
+
+func (t targetOptions) urns() []string {
+	return append(append(append([]string{}, t.target...), t.exclude...), t.replace...)
+}
+
+// validateTargets checks that every URN of the options exists in the stack so
+// that a typo doesn't turn the operation into a no-op. URNs with wildcards are
+// not validated.
+func (m *Pulumi) validateTargets(ctx context.Context, src *dagger.Directory, stack string, t targetOptions) error {
+	urns := t.urns()
+	if len(urns) == 0 {
+		return nil
+	}
+
+	existing, err := m.stackUrns(ctx, src, stack)
+	if err != nil {
+		return err
+	}
+
+	unknown := []string{}
+	for _, urn := range urns {
+		if !strings.Contains(urn, "*") && !existing[urn] {
+			unknown = append(unknown, urn)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("resources not found in stack %s:\n%s", stack, strings.Join(unknown, "\n"))
+	}
+	return nil
+}
+
+// stackUrns returns the URNs of the resources of the stack from `pulumi stack export`.
+// The state is exported to a file so that it doesn't show up in the logs.
+func (m *Pulumi) stackUrns(ctx context.Context, src *dagger.Directory, stack string) (map[string]bool, error) {
+	state, err := m.StackExport(ctx, src, stack, false)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := state.Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	export := struct {
+		Deployment struct {
+			Resources []struct {
+				Urn string `json:"urn"`
+			} `json:"resources"`
+		} `json:"deployment"`
+	}{}
+	if err := json.Unmarshal([]byte(out), &export); err != nil {
+		return nil, err
+	}
+
+	urns := make(map[string]bool, len(export.Deployment.Resources))
+	for _, r := range export.Deployment.Resources {
+		urns[r.Urn] = true
+	}
+	return urns, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"main/internal/dagger"
+)
+
+// testReportPath is where the JUnit report of the unit tests is written
+const testReportPath = "/tmp/pulumi-junit.xml"
+
+// Runs the unit tests of the program returning their JUnit report. The tests are
+// run with the toolchain of the runtime: gotestsum for go, the test script of the
+// package manager for nodejs and pytest for python. Tests that use the mocks of
+// the Pulumi SDK need neither cloud credentials nor the Pulumi token.
+// The test script of nodejs projects has to set up a JUnit reporter, such as
+// jest-junit or mocha-junit-reporter, which write the report to the path set on
+// JEST_JUNIT_OUTPUT_FILE and MOCHA_FILE.
+func (m *Pulumi) Test(ctx context.Context, src *dagger.Directory,
+	// Return the report even if the tests fail
+	// +optional
+	ignoreFailures bool,
+) (*dagger.File, error) {
+	project, err := readProject(ctx, m.projectDir(src))
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := project.Runtime.testCommand(ctx, m.projectDir(src), testReportPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unit tests need neither the policy packs nor the Docker Engine
+	ct, err := m.runtimeContainer(ctx, src, nil, m.Version, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ct = ct.
+		WithEnvVariable("JEST_JUNIT_OUTPUT_FILE", testReportPath).
+		WithEnvVariable("MOCHA_FILE", testReportPath).
+		WithExec(cmd, dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		})
+
+	exitCode, err := ct.ExitCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 && !ignoreFailures {
+		stdout, _ := ct.Stdout(ctx)
+		stderr, _ := ct.Stderr(ctx)
+		return nil, fmt.Errorf("tests failed with exit code %d:\n%s%s", exitCode, stdout, stderr)
+	}
+
+	report := ct.File(testReportPath)
+	if _, err := report.Sync(ctx); err != nil {
+		if project.Runtime.Name == "nodejs" {
+			return nil, fmt.Errorf("the tests didn't write a JUnit report to %s. The test script of nodejs projects has to set up a JUnit reporter, "+
+				"such as jest-junit or mocha-junit-reporter, which write it to the path set on JEST_JUNIT_OUTPUT_FILE and MOCHA_FILE: %w", testReportPath, err)
+		}
+		return nil, fmt.Errorf("the tests didn't write a JUnit report to %s: %w", testReportPath, err)
+	}
+	return report, nil
+}